@@ -0,0 +1,301 @@
+package sip2
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ACSHandler is implemented by the ILS side of an ACSServer, one method per SC message.
+// Returning an error drops the connection, a refused transaction should be reported
+// through the response fields (OK, ValidPatron...) instead.
+type ACSHandler interface {
+	Login(ctx context.Context, req *LoginRequest) (*LoginResponse, error)
+	SCStatus(ctx context.Context, req *SCStatusRequest) (*ACSStatusResponse, error)
+	PatronStatus(ctx context.Context, req *PatronStatusRequest) (*PatronStatusResponse, error)
+	PatronInformation(ctx context.Context, req *PatronInformationRequest) (*PatronInformationResponse, error)
+	ItemInformation(ctx context.Context, req *ItemInformationRequest) (*ItemInformationResponse, error)
+	Checkout(ctx context.Context, req *CheckoutRequest) (*CheckoutResponse, error)
+	Checkin(ctx context.Context, req *CheckinRequest) (*CheckinResponse, error)
+	BlockPatron(ctx context.Context, req *BlockPatronRequest) (*PatronStatusResponse, error)
+	EndPatronSession(ctx context.Context, req *EndPatronSessionRequest) (*EndSessionResponse, error)
+	FeePaid(ctx context.Context, req *FeePaidRequest) (*FeePaidResponse, error)
+	ItemStatusUpdate(ctx context.Context, req *ItemStatusUpdateRequest) (*ItemStatusUpdateResponse, error)
+	PatronEnable(ctx context.Context, req *PatronEnableRequest) (*PatronEnableResponse, error)
+	Hold(ctx context.Context, req *HoldRequest) (*HoldResponse, error)
+	Renew(ctx context.Context, req *RenewRequest) (*RenewResponse, error)
+	RenewAll(ctx context.Context, req *RenewAllRequest) (*RenewAllResponse, error)
+}
+
+// ACSSession is the state of one SC connection, handlers can get it by SessionFromContext.
+type ACSSession struct {
+	RemoteAddr   string
+	LoginUserID  string
+	LocationCode string
+	LoggedIn     bool
+}
+
+type acsSessionKey struct{}
+
+func SessionFromContext(ctx context.Context) *ACSSession {
+	session, _ := ctx.Value(acsSessionKey{}).(*ACSSession)
+	return session
+}
+
+type ACSServer struct {
+	host           string
+	port           int
+	handler        ACSHandler
+	timeout        int
+	requireLogin   bool
+	errorDetection bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+	listener       net.Listener
+	conns          map[net.Conn]struct{}
+	wg             sync.WaitGroup
+}
+
+func NewACSServer(host string, port int, handler ACSHandler, timeout int, requireLogin, errorDetection bool) *ACSServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ACSServer{
+		host:           host,
+		port:           port,
+		handler:        handler,
+		timeout:        timeout,
+		requireLogin:   requireLogin,
+		errorDetection: errorDetection,
+		ctx:            ctx,
+		cancel:         cancel,
+		conns:          make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *ACSServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", net.JoinHostPort(s.host, fmt.Sprint(s.port)))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *ACSServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *ACSServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *ACSServer) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	session := &ACSSession{RemoteAddr: conn.RemoteAddr().String()}
+	ctx := context.WithValue(s.ctx, acsSessionKey{}, session)
+	reader := bufio.NewReader(conn)
+	var lastResp []byte
+	for {
+		if s.timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(s.timeout) * time.Second))
+		}
+		raw, err := reader.ReadBytes('\r')
+		if err != nil {
+			return
+		}
+		body, seq, err := ParseFrame(raw, s.errorDetection)
+		if err == nil && len(body) == 0 {
+			continue
+		}
+		if err == nil && len(body) >= 2 && string(body[:2]) == "97" {
+			if lastResp != nil {
+				err = writeFrame(conn, lastResp)
+				if err != nil {
+					return
+				}
+			}
+			continue
+		}
+		var req interface{}
+		if err == nil {
+			req, err = DecodeRequest(body)
+		}
+		if err != nil {
+			err = writeFrame(conn, BuildFrame([]byte("96"), -1))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if s.requireLogin && !session.LoggedIn {
+			switch req.(type) {
+			case *LoginRequest, *SCStatusRequest:
+			default:
+				err = writeFrame(conn, loginRequired(req, seq))
+				if err != nil {
+					return
+				}
+				continue
+			}
+		}
+		resp, err := s.dispatch(ctx, session, req)
+		if err != nil {
+			return
+		}
+		b, err := EncodeResponse(resp, seq)
+		if err != nil {
+			return
+		}
+		lastResp = b
+		err = writeFrame(conn, b)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// loginRequired is the rejection of a request received before the SC logged in: the
+// response of the command with OK unset, the ids of the request and a screen message,
+// or a resend request (96) when the command has no response.
+func loginRequired(req interface{}, seq int) []byte {
+	id, _ := strconv.Atoi(commandID(req))
+	respID := fmt.Sprintf("%02d", id+1)
+	if id == 1 {
+		respID = "24"
+	}
+	resp, err := GenResponse(respID)
+	if err != nil {
+		return BuildFrame([]byte("96"), -1)
+	}
+	reqVal, respVal := reflect.ValueOf(req).Elem(), reflect.ValueOf(resp).Elem()
+	for _, name := range []string{"InstitutionID", "PatronID", "ItemID"} {
+		from, to := reqVal.FieldByName(name), respVal.FieldByName(name)
+		if from.IsValid() && to.IsValid() && from.Type() == to.Type() {
+			to.Set(from)
+		}
+	}
+	if date := respVal.FieldByName("TransactionDate"); date.IsValid() {
+		*date.Addr().Interface().(*TransactionDate).TimeValue = TimeValue(time.Now())
+	}
+	if msg := respVal.FieldByName("ScreenMessage"); msg.IsValid() {
+		*msg.Addr().Interface().(*ScreenMessage).StrValue = "login required"
+	}
+	b, _ := EncodeResponse(resp, seq)
+	return b
+}
+
+// writeFrame terminates the frame with a line feed after the carriage return,
+// ClientPool and most line oriented SC clients read up to it.
+func writeFrame(conn net.Conn, b []byte) error {
+	_, err := conn.Write(append(b[:len(b):len(b)], '\n'))
+	return err
+}
+
+func (s *ACSServer) dispatch(ctx context.Context, session *ACSSession, req interface{}) (interface{}, error) {
+	switch r := req.(type) {
+	case *LoginRequest:
+		resp, err := s.handler.Login(ctx, r)
+		if err != nil || resp == nil {
+			return resp, err
+		}
+		fillResponse(resp)
+		if *resp.OK.BoolValue {
+			session.LoggedIn = true
+			session.LoginUserID = string(*r.LoginUserID.StrValue)
+			session.LocationCode = string(*r.LocationCode.StrValue)
+		}
+		return resp, nil
+	case *SCStatusRequest:
+		return s.handler.SCStatus(ctx, r)
+	case *PatronStatusRequest:
+		return s.handler.PatronStatus(ctx, r)
+	case *PatronInformationRequest:
+		return s.handler.PatronInformation(ctx, r)
+	case *ItemInformationRequest:
+		return s.handler.ItemInformation(ctx, r)
+	case *CheckoutRequest:
+		return s.handler.Checkout(ctx, r)
+	case *CheckinRequest:
+		return s.handler.Checkin(ctx, r)
+	case *BlockPatronRequest:
+		return s.handler.BlockPatron(ctx, r)
+	case *EndPatronSessionRequest:
+		return s.handler.EndPatronSession(ctx, r)
+	case *FeePaidRequest:
+		return s.handler.FeePaid(ctx, r)
+	case *ItemStatusUpdateRequest:
+		return s.handler.ItemStatusUpdate(ctx, r)
+	case *PatronEnableRequest:
+		return s.handler.PatronEnable(ctx, r)
+	case *HoldRequest:
+		return s.handler.Hold(ctx, r)
+	case *RenewRequest:
+		return s.handler.Renew(ctx, r)
+	case *RenewAllRequest:
+		return s.handler.RenewAll(ctx, r)
+	default:
+		return nil, fmt.Errorf("ACSServer.dispatch: unsupported request %T", req)
+	}
+}
+
+func (s *ACSServer) Shutdown(ctx context.Context) error {
+	s.cancel()
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("*ACSServer.Shutdown: " + ctx.Err().Error())
+	}
+}
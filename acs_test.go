@@ -0,0 +1,157 @@
+package sip2
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testACS struct {
+	ACSHandler
+}
+
+func (a *testACS) Login(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
+	resp := NewLoginResponse()
+	*resp.OK.BoolValue = BoolValue(*req.LoginPassword.StrValue == "secret")
+	return resp, nil
+}
+
+func (a *testACS) Checkout(ctx context.Context, req *CheckoutRequest) (*CheckoutResponse, error) {
+	resp := NewCheckoutResponse()
+	*resp.OK.BoolValue = true
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	*resp.ItemID.StrValue = *req.ItemID.StrValue
+	*resp.DueDate.TimeValue = TimeValue(time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC))
+	*resp.ScreenMessage.StrValue = StrValue("checked out by " + SessionFromContext(ctx).LoginUserID)
+	return resp, nil
+}
+
+func startTestACS(t *testing.T, requireLogin bool) (*ACSServer, *net.TCPAddr) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewACSServer("127.0.0.1", 0, &testACS{}, 5, requireLogin, true)
+	go server.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return server, l.Addr().(*net.TCPAddr)
+}
+
+func TestACSServerCheckout(t *testing.T) {
+	_, addr := startTestACS(t, true)
+	pool, err := NewClientPool(addr.IP.String(), addr.Port, 1, 5, 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := NewLoginRequest()
+	*login.LoginUserID.StrValue = "kiosk1"
+	*login.LoginPassword.StrValue = "secret"
+	resp, err := pool.ReliableCommunicate(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*resp.(*LoginResponse).OK.BoolValue {
+		t.Fatal("login refused")
+	}
+	checkout := NewCheckoutRequest()
+	*checkout.PatronID.StrValue = "P001"
+	*checkout.ItemID.StrValue = "I001"
+	resp, err = pool.ReliableCommunicate(checkout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkoutResp := resp.(*CheckoutResponse)
+	if !*checkoutResp.OK.BoolValue || *checkoutResp.PatronID.StrValue != "P001" || *checkoutResp.ItemID.StrValue != "I001" {
+		t.Fatalf("unexpected checkout response: %s", encodeFields(checkoutResp))
+	}
+	if *checkoutResp.ScreenMessage.StrValue != "checked out by kiosk1" {
+		t.Fatalf("unexpected screen message: %s", *checkoutResp.ScreenMessage.StrValue)
+	}
+	if time.Time(*checkoutResp.DueDate.TimeValue).Day() != 1 {
+		t.Fatalf("unexpected due date: %v", time.Time(*checkoutResp.DueDate.TimeValue))
+	}
+}
+
+func TestACSServerResend(t *testing.T) {
+	_, addr := startTestACS(t, false)
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("1100N20180416    15070120180416    150701AOinst|AAP001|ABI001|AC|AY1AZ0000\r"))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[:2] != "96" {
+		t.Fatalf("expected resend request, got %q", line)
+	}
+	req := NewCheckoutRequest()
+	*req.PatronID.StrValue = "P001"
+	b, _ := EncodeRequestSeq(req, 3)
+	conn.Write(b)
+	first, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[:2] != "12" || !strings.Contains(first, "AY3AZ") {
+		t.Fatalf("expected checkout response with sequence 3, got %q", first)
+	}
+	b, _ = EncodeRequestSeq(NewResendRequest(), -1)
+	conn.Write(b)
+	second, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatalf("resend mismatch: %q != %q", first, second)
+	}
+}
+
+func TestACSServerLoginRequired(t *testing.T) {
+	_, addr := startTestACS(t, true)
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	checkout := NewCheckoutRequest()
+	*checkout.PatronID.StrValue = "P001"
+	*checkout.ItemID.StrValue = "I001"
+	b, _ := EncodeRequestSeq(checkout, 4)
+	conn.Write(b)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, seq, err := ParseFrame([]byte(strings.TrimSuffix(line, "\n")), true)
+	if err != nil || seq != 4 {
+		t.Fatalf("unexpected frame %q: %v", line, err)
+	}
+	if line[:3] != "12N" || !strings.Contains(line, "|AAP001|") || !strings.Contains(line, "|AFlogin required|") {
+		t.Fatalf("expected a rejection, got %q", line)
+	}
+	login := NewLoginRequest()
+	*login.LoginUserID.StrValue = "kiosk1"
+	*login.LoginPassword.StrValue = "secret"
+	b, _ = EncodeRequestSeq(login, 5)
+	conn.Write(b)
+	if line, err = reader.ReadString('\n'); err != nil || line[:3] != "94Y" {
+		t.Fatalf("expected a login on the same connection, got %q: %v", line, err)
+	}
+	b, _ = EncodeRequestSeq(checkout, 6)
+	conn.Write(b)
+	if line, err = reader.ReadString('\n'); err != nil || line[:3] != "12Y" {
+		t.Fatalf("expected a checkout after the login, got %q: %v", line, err)
+	}
+}
@@ -0,0 +1,277 @@
+package sip2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is an exchange with the ACS made for a client. Outcome is "ok", "rejected",
+// "offline" for a transaction journaled by the offline mode, or the error code of a
+// failure. The passwords of Request and Response are always redacted.
+type AuditRecord struct {
+	Time      time.Time              `json:"time"`
+	Client    string                 `json:"client"`
+	Method    string                 `json:"method"`
+	PatronID  string                 `json:"patron_id,omitempty"`
+	ItemID    string                 `json:"item_id,omitempty"`
+	Outcome   string                 `json:"outcome"`
+	Message   string                 `json:"message,omitempty"`
+	LatencyMS float64                `json:"latency_ms"`
+	Request   map[string]interface{} `json:"request"`
+	Response  map[string]interface{} `json:"response,omitempty"`
+}
+
+// AuditSink receives the audit records, Audit is called concurrently.
+type AuditSink interface {
+	Audit(rec *AuditRecord) error
+}
+
+// WithAudit records every exchange of the pool in sink, see ClientPool.SetAudit, the records
+// of the requests of a client name it. The transactions answered offline are recorded too.
+func WithAudit(sink AuditSink) Option {
+	return func(ss *SIPServer) {
+		ss.audit = sink
+		ss.pool.SetAudit(sink, "gateway")
+	}
+}
+
+// SetAudit records every exchange of the pool with the ACS in sink: the requests, those of
+// Sequence included, the logins of the connections and the End Patron Sessions of Close.
+// client names the records of the exchanges made for no client. It should be called before
+// the pool is in use.
+func (p *ClientPool) SetAudit(sink AuditSink, client string) {
+	p.audit, p.auditClient = sink, client
+}
+
+type auditClientKey struct{}
+
+// withAuditClient makes the exchanges made with ctx recorded for client.
+func withAuditClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, auditClientKey{}, client)
+}
+
+// auditExchange records an exchange started at start, when the pool has an audit sink.
+func (p *ClientPool) auditExchange(ctx context.Context, start time.Time, req, resp interface{}, err error) {
+	if p.audit == nil {
+		return
+	}
+	client, ok := ctx.Value(auditClientKey{}).(string)
+	if !ok {
+		client = p.auditClient
+	}
+	method := methodName(req)
+	if auditErr := p.audit.Audit(newAuditRecord(start, client, method, req, resp, false, err)); auditErr != nil {
+		p.logger.Log(LevelError, "audit failed", F("method", method), F("error", auditErr))
+	}
+}
+
+var (
+	methodNamesOnce sync.Once
+	methodNames     map[reflect.Type]string
+)
+
+// methodName is the method of the JSON API of a request, or its type name.
+func methodName(req interface{}) string {
+	methodNamesOnce.Do(func() {
+		methodNames = make(map[reflect.Type]string, len(MethodMap))
+		for name, newRequest := range MethodMap {
+			methodNames[reflect.TypeOf(newRequest())] = name
+		}
+	})
+	if name, ok := methodNames[reflect.TypeOf(req)]; ok {
+		return name
+	}
+	return reflect.TypeOf(req).Elem().Name()
+}
+
+// clientIdentity is the credential name of a request, or else its terminal.
+func clientIdentity(r *http.Request) string {
+	if cred, ok := CredentialFromContext(r.Context()); ok {
+		return cred.Name
+	}
+	return terminalOf(r)
+}
+
+func newAuditRecord(start time.Time, client, method string, req, resp interface{}, offline bool, err error) *AuditRecord {
+	val := reflect.ValueOf(req).Elem()
+	rec := &AuditRecord{
+		Time:      start,
+		Client:    client,
+		Method:    method,
+		PatronID:  stringField(val, "PatronID"),
+		ItemID:    stringField(val, "ItemID"),
+		Outcome:   "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Request:   redactedMap(req),
+	}
+	if resp != nil {
+		rec.Response = redactedMap(resp)
+	}
+	if err == nil {
+		err = rejection(resp)
+	}
+	switch {
+	case err != nil && errors.Is(err, ErrRejected):
+		rec.Outcome, rec.Message = "rejected", err.Error()
+	case err != nil:
+		_, rec.Outcome = ErrorStatus(err)
+		rec.Message = err.Error()
+	case offline:
+		rec.Outcome = "offline"
+	}
+	return rec
+}
+
+// redactedMap is the JSON of a message as a map, the password fields replaced.
+func redactedMap(msg interface{}) map[string]interface{} {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	json.Unmarshal(b, &m)
+	for name, value := range m {
+		if strings.Contains(name, "password") && value != "" {
+			m[name] = "[redacted]"
+		}
+	}
+	return m
+}
+
+// AuditLog is the AuditSink appending the records to a JSONL file, renamed with the time
+// as suffix and started anew once it reaches maxBytes. Rotated files are never removed.
+type AuditLog struct {
+	path     string
+	maxBytes int64
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+}
+
+func NewAuditLog(path string, maxBytes int64) (*AuditLog, error) {
+	al := &AuditLog{path: path, maxBytes: maxBytes}
+	err := al.open()
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	f, err := os.OpenFile(al.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.f, al.size = f, info.Size()
+	return nil
+}
+
+func (al *AuditLog) Audit(rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.maxBytes > 0 && al.size > 0 && al.size+int64(len(b)) > al.maxBytes {
+		if err = al.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := al.f.Write(b)
+	al.size += int64(n)
+	return err
+}
+
+func (al *AuditLog) rotate() error {
+	err := al.f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(al.path, al.path+"."+time.Now().Format("20060102T150405.000000000"))
+	if err != nil {
+		return err
+	}
+	return al.open()
+}
+
+func (al *AuditLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.f.Close()
+}
+
+// AuditFilter selects audit records, the zero values select all.
+type AuditFilter struct {
+	PatronID string
+	ItemID   string
+	From     time.Time
+	To       time.Time
+}
+
+func (af AuditFilter) match(rec *AuditRecord) bool {
+	switch {
+	case af.PatronID != "" && rec.PatronID != af.PatronID:
+		return false
+	case af.ItemID != "" && rec.ItemID != af.ItemID:
+		return false
+	case !af.From.IsZero() && rec.Time.Before(af.From):
+		return false
+	case !af.To.IsZero() && !rec.Time.Before(af.To):
+		return false
+	}
+	return true
+}
+
+// QueryAudit returns the records of the audit log at path and of its rotated files
+// selected by filter, oldest first.
+func QueryAudit(path string, filter AuditFilter) ([]AuditRecord, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	var records []AuditRecord
+	for _, p := range append(rotated, path) {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4<<20)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+				continue
+			}
+			if filter.match(&rec) {
+				records = append(records, rec)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
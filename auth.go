@@ -0,0 +1,269 @@
+package sip2
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The headers of a request signed with SignRequest.
+const (
+	KeyIDHeader     = "X-Key-ID"
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+// Credential is an authenticated client and what it may do: the methods of the JSON API
+// and the institution ids of its requests, an empty list allows all. KeyID is the id of the
+// APIKey entry of a KeyAuthenticator, ClientCertCN the common name of the verified client
+// certificate of the request, if any.
+type Credential struct {
+	Name           string
+	KeyID          string
+	Methods        []string
+	InstitutionIDs []string
+	ClientCertCN   string
+	// boundCertCN is the common name the key is bound to, see APIKey
+	boundCertCN string
+}
+
+// Authenticator identifies the client of a request, it returns an error wrapping
+// ErrUnauthorized when the client cannot be identified.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Credential, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(r *http.Request) (*Credential, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Credential, error) {
+	return f(r)
+}
+
+// WithAuthenticator authenticates every request with auth before it is routed, Route and
+// RouteREST then refuse the methods and institutions the credential is not allowed.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(ss *SIPServer) {
+		ss.auth = auth
+	}
+}
+
+type credentialKey struct{}
+
+// RequireAuth is the middleware of WithAuthenticator: it authenticates the request and
+// passes its credential in the context, see CredentialFromContext.
+func RequireAuth(auth Authenticator, errHandler func(http.ResponseWriter, error), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, err := auth.Authenticate(r)
+		if err != nil {
+			errHandler(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), credentialKey{}, cred)))
+	})
+}
+
+// CredentialFromContext returns the credential set by RequireAuth.
+func CredentialFromContext(ctx context.Context) (*Credential, bool) {
+	cred, ok := ctx.Value(credentialKey{}).(*Credential)
+	return cred, ok && cred != nil
+}
+
+// connectionMethods act on the pooled connection rather than on a patron or an item, only
+// the credentials listing them in Methods may call them.
+var connectionMethods = []string{"login"}
+
+// authorize checks the method and the institution of a request against its credential.
+func (ss *SIPServer) authorize(ctx context.Context, method string, req interface{}) error {
+	if ss.auth == nil {
+		return nil
+	}
+	cred, ok := CredentialFromContext(ctx)
+	if !ok {
+		return newError(ErrUnauthorized, "not authenticated")
+	}
+	if cred.boundCertCN != "" && cred.ClientCertCN != cred.boundCertCN {
+		return newError(ErrForbidden, "key of "+cred.Name+" used without its client certificate")
+	}
+	if len(cred.Methods) > 0 && !oneOf(method, cred.Methods) {
+		return newError(ErrForbidden, "method "+method+" not allowed for "+cred.Name)
+	}
+	// a login changes the ACS user of a shared connection, it must be allowed by name
+	if oneOf(method, connectionMethods) && !oneOf(method, cred.Methods) {
+		return newError(ErrForbidden, "method "+method+" not allowed for "+cred.Name)
+	}
+	if len(cred.InstitutionIDs) > 0 {
+		if !HasField(req, "institution_id") {
+			return newError(ErrForbidden, "method "+method+" has no institution, not allowed for "+cred.Name)
+		}
+		institutionID := stringField(reflect.ValueOf(req).Elem(), "InstitutionID")
+		if !oneOf(institutionID, cred.InstitutionIDs) {
+			return newError(ErrForbidden, "institution not allowed for "+cred.Name)
+		}
+	}
+	return nil
+}
+
+// APIKey is a key of the gateway config. A key is sent as is in the X-API-Key header, or
+// with HMAC set, used as the secret of the signature of requests naming it by ID. With
+// ClientCertCN set, the requests without a key from a client presenting a verified
+// certificate of this common name get the credential of the entry, and the key of the
+// entry is only accepted from such a client.
+type APIKey struct {
+	ID             string   `json:"id"`
+	Key            string   `json:"key"`
+	HMAC           bool     `json:"hmac"`
+	ClientCertCN   string   `json:"client_cert_cn"`
+	Methods        []string `json:"methods"`
+	InstitutionIDs []string `json:"institution_ids"`
+}
+
+// KeyAuthenticator is the built-in Authenticator of API keys and HMAC signed requests. A
+// signed request is refused when its timestamp is more than MaxSkew away from now or when
+// its key id and nonce were already seen.
+type KeyAuthenticator struct {
+	MaxSkew time.Duration
+	keys    []APIKey
+	mu      sync.Mutex
+	seen    map[string]time.Time
+}
+
+func NewKeyAuthenticator(keys []APIKey) *KeyAuthenticator {
+	return &KeyAuthenticator{
+		MaxSkew: 5 * time.Minute,
+		keys:    keys,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+func (ka *KeyAuthenticator) Authenticate(r *http.Request) (*Credential, error) {
+	cred, err := ka.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	cred.ClientCertCN = ClientCertCN(r)
+	return cred, nil
+}
+
+func (ka *KeyAuthenticator) authenticate(r *http.Request) (*Credential, error) {
+	if r.Header.Get(SignatureHeader) != "" {
+		return ka.verifySignature(r)
+	}
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		if cn := ClientCertCN(r); cn != "" {
+			for i := range ka.keys {
+				if ka.keys[i].ClientCertCN == cn {
+					return ka.keys[i].credential(), nil
+				}
+			}
+		}
+		return nil, newError(ErrUnauthorized, "missing API key")
+	}
+	for i := range ka.keys {
+		k := &ka.keys[i]
+		if !k.HMAC && k.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			return k.credential(), nil
+		}
+	}
+	return nil, newError(ErrUnauthorized, "invalid API key")
+}
+
+func (ka *KeyAuthenticator) verifySignature(r *http.Request) (*Credential, error) {
+	var key *APIKey
+	for i := range ka.keys {
+		if ka.keys[i].HMAC && ka.keys[i].ID == r.Header.Get(KeyIDHeader) {
+			key = &ka.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, newError(ErrUnauthorized, "unknown key id")
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, newError(ErrUnauthorized, "invalid timestamp")
+	}
+	now := time.Now()
+	signedAt := time.Unix(ts, 0)
+	if signedAt.Before(now.Add(-ka.MaxSkew)) || signedAt.After(now.Add(ka.MaxSkew)) {
+		return nil, newError(ErrUnauthorized, "timestamp out of range")
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	// the URI as sent, whatever a StripPrefix in front of the handler did to r.URL
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	nonce := r.Header.Get(NonceHeader)
+	if nonce == "" || len(nonce) > 128 {
+		return nil, newError(ErrUnauthorized, "invalid nonce")
+	}
+	sent := r.Header.Get(SignatureHeader)
+	expected := signature(key.Key, r.Method, uri, r.Header.Get(TimestampHeader), nonce, body)
+	if !hmac.Equal([]byte(sent), []byte(expected)) {
+		return nil, newError(ErrUnauthorized, "invalid signature")
+	}
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	for s, t := range ka.seen {
+		if now.Sub(t) > 2*ka.MaxSkew {
+			delete(ka.seen, s)
+		}
+	}
+	seenKey := key.ID + "\n" + nonce
+	if _, ok := ka.seen[seenKey]; ok {
+		return nil, newError(ErrUnauthorized, "replayed request")
+	}
+	ka.seen[seenKey] = now
+	return key.credential(), nil
+}
+
+func (k *APIKey) credential() *Credential {
+	name := k.ID
+	if name == "" {
+		name = k.ClientCertCN
+	}
+	if name == "" {
+		name = "api key"
+	}
+	cred := &Credential{Name: name, KeyID: k.ID, Methods: k.Methods, InstitutionIDs: k.InstitutionIDs}
+	if k.Key != "" {
+		cred.boundCertCN = k.ClientCertCN
+	}
+	return cred
+}
+
+// SignRequest sets the headers of an HMAC signed request with a random nonce, body is the
+// request body.
+func SignRequest(r *http.Request, keyID, secret string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := randomHex(16)
+	r.Header.Set(KeyIDHeader, keyID)
+	r.Header.Set(TimestampHeader, ts)
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(SignatureHeader, signature(secret, r.Method, r.URL.RequestURI(), ts, nonce, body))
+}
+
+// signature is the hex HMAC-SHA256 of the method, the request URI, the timestamp, the nonce
+// and the body, separated by newlines.
+func signature(secret, method, uri, ts, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + ts + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,197 @@
+package sip2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// maxBatchEntries bounds the entries of a batch.
+const maxBatchEntries = 50
+
+// BatchRequest is the body of the batch endpoint: the entries run in order on one pooled
+// connection, or at once with Parallel. StopOnError skips the entries after the first
+// failure, it cannot be set with Parallel.
+type BatchRequest struct {
+	Header  BatchHeader  `json:"header"`
+	Entries []BatchEntry `json:"entries"`
+}
+
+type BatchHeader struct {
+	Parallel    bool `json:"parallel"`
+	StopOnError bool `json:"stop_on_error"`
+}
+
+// BatchEntry is a method of the JSON API and its data.
+type BatchEntry struct {
+	Method string          `json:"method"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// BatchResult is the outcome of an entry, in the item_list of the response in the order
+// of the entries. Code and ErrorCode are the ones the entry alone would be answered with,
+// RetryAfter the seconds its Retry-After header would have for a rate limited entry.
+type BatchResult struct {
+	Method     string      `json:"method"`
+	Code       int         `json:"code"`
+	ErrorCode  string      `json:"error_code,omitempty"`
+	Msg        string      `json:"msg"`
+	Item       interface{} `json:"item"`
+	RetryAfter int         `json:"retry_after,omitempty"`
+}
+
+// RouteBatch serves the batch endpoint. The entries are checked (method, profile,
+// authorization, validation, rate limits) before a pool connection is taken, the response
+// is a 200 listing a BatchResult per entry.
+func (ss *SIPServer) RouteBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		ss.errHandler(w, newError(ErrMethodNotAllowed, "method not allowed"))
+		return
+	}
+	profile, err := ss.selectProfile(r)
+	if err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	batch := &BatchRequest{}
+	if err = json.Unmarshal(body, batch); err != nil {
+		ss.errHandler(w, newError(ErrValidation, err.Error()))
+		return
+	}
+	if len(batch.Entries) == 0 || len(batch.Entries) > maxBatchEntries {
+		ss.errHandler(w, newError(ErrValidation, "a batch has 1 to 50 entries"))
+		return
+	}
+	if batch.Header.Parallel && batch.Header.StopOnError {
+		ss.errHandler(w, newError(ErrValidation, "stop_on_error cannot be set with parallel"))
+		return
+	}
+	results := make([]BatchResult, len(batch.Entries))
+	reqs := make([]interface{}, len(batch.Entries))
+	stopped := len(batch.Entries)
+	for i, entry := range batch.Entries {
+		results[i].Method = entry.Method
+		req, err := ss.buildRequest(r, profile, entry.Method, entry.Data)
+		header := http.Header{}
+		if err == nil {
+			err = ss.checkRateLimits(header, r, entry.Method, req)
+		}
+		if err != nil {
+			results[i].fail(err)
+			results[i].RetryAfter, _ = strconv.Atoi(header.Get("Retry-After"))
+			if batch.Header.StopOnError {
+				stopped = i
+				break
+			}
+			continue
+		}
+		reqs[i] = req
+	}
+	if batch.Header.Parallel {
+		ss.runParallel(r, reqs, results)
+	} else {
+		err = ss.runSequence(r, reqs[:stopped], results, batch.Header.StopOnError)
+		if err != nil {
+			ss.errHandler(w, err)
+			return
+		}
+	}
+	if batch.Header.StopOnError {
+		// the entries failing their checks after the first failed exchange were never reached
+		for i := range results {
+			if results[i].Code != 0 && results[i].Code != http.StatusOK {
+				for j := i + 1; j < len(results); j++ {
+					if reqs[j] == nil {
+						results[j] = BatchResult{Method: results[j].Method}
+					}
+				}
+				break
+			}
+		}
+	}
+	resp := NewJSONResponse("2.0", "ok", http.StatusOK)
+	resp.Data.ItemList = make([]interface{}, len(results))
+	for i, result := range results {
+		if result.Code == 0 {
+			result.Msg, result.ErrorCode = "skipped after a failed entry", "skipped"
+		}
+		resp.Data.ItemList[i] = result
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// runSequence exchanges the requests on one connection, a nil request failed its checks.
+func (ss *SIPServer) runSequence(r *http.Request, reqs []interface{}, results []BatchResult, stopOnError bool) error {
+	pending := false
+	for _, req := range reqs {
+		pending = pending || req != nil
+	}
+	if !pending {
+		return nil
+	}
+	ctx := withAuditClient(r.Context(), clientIdentity(r))
+	return ss.pool.SequenceContext(ctx, func(send func(req interface{}) (interface{}, error)) error {
+		communicate := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return send(req)
+		}
+		for i, req := range reqs {
+			if req == nil {
+				continue
+			}
+			resp, err := ss.send(r, results[i].Method, req, communicate)
+			if err == nil {
+				err = rejection(resp)
+			}
+			if err != nil {
+				results[i].fail(err)
+				if stopOnError {
+					return nil
+				}
+				continue
+			}
+			results[i].succeed(resp)
+		}
+		return nil
+	})
+}
+
+// runParallel exchanges the requests at once, a nil request failed its checks.
+func (ss *SIPServer) runParallel(r *http.Request, reqs []interface{}, results []BatchResult) {
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		if req == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, req interface{}) {
+			defer wg.Done()
+			resp, err := ss.send(r, results[i].Method, req, ss.pool.ReliableCommunicateContext)
+			if err == nil {
+				err = rejection(resp)
+			}
+			if err != nil {
+				results[i].fail(err)
+				return
+			}
+			results[i].succeed(resp)
+		}(i, req)
+	}
+	wg.Wait()
+}
+
+func (br *BatchResult) succeed(resp interface{}) {
+	br.Code, br.Msg, br.Item = http.StatusOK, "ok", resp
+}
+
+func (br *BatchResult) fail(err error) {
+	br.Code, br.ErrorCode = ErrorStatus(err)
+	br.Msg, br.Item = err.Error(), errorItem(err)
+}
@@ -2,182 +2,557 @@ package sip2
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
-	"runtime"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 )
 
 type ClientPool struct {
 	length         uint64
-	index          uint64
-	conns          []*net.TCPConn
+	seq            uint64
+	conns          chan net.Conn
 	host           string
 	port           int
+	tlsConfig      *tls.Config
 	timeout        int
 	retryTimes     int
 	errorDetection bool
+	recorder       *Recorder
+	metrics        *Metrics
+	logger         Logger
+	login          *LoginRequest
+	endSessions    bool
+	// swept is set and closed is closed once Close has closed the pooled connections
+	swept     int32
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	inFlight  int
+	closing   bool
+	idle      chan struct{}
+	sessions  map[string]patronSession
+	// frameDebug are the command ids of the requests logged with their full frames
+	frameDebug   map[string]bool
+	interceptors []Interceptor
+	tracer       Tracer
+	audit        AuditSink
+	auditClient  string
 }
 
-func newConn(host string, port int) (*net.TCPConn, error) {
-	sAddr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.Dial("tcp", sAddr)
-	if err != nil {
-		return nil, err
-	}
-	tcpConn := conn.(*net.TCPConn)
-	err = tcpConn.SetKeepAlive(true)
-	if err != nil {
-		return nil, err
+// patronSession is a patron seen in a request and not ended by an End Patron Session yet,
+// seen is the time of its last request.
+type patronSession struct {
+	institutionID string
+	patronID      string
+	seen          time.Time
+}
+
+const (
+	// sessionIdleTTL is the idle time after which a patron session is left to the ACS
+	sessionIdleTTL = 10 * time.Minute
+	// maxSessions bounds the patron sessions tracked, the least recently seen is dropped
+	maxSessions = 1000
+)
+
+var errPoolClosed = newError(ErrACSUnavailable, "ReliableCommunicate: pool closed")
+
+// newConn dials the ACS, over TLS when tlsConfig is not nil.
+func newConn(host string, port, timeout int, tlsConfig *tls.Config) (net.Conn, error) {
+	sAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: time.Duration(timeout) * time.Second, KeepAlive: 15 * time.Second}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", sAddr, tlsConfig)
 	}
-	return tcpConn, nil
+	return dialer.Dial("tcp", sAddr)
 }
 
 func NewClientPool(host string, port, poolSize, timeout, retryTimes int, errorDetection bool) (*ClientPool, error) {
-	conns := make([]*net.TCPConn, 0, poolSize)
+	return NewTLSClientPool(host, port, poolSize, timeout, retryTimes, errorDetection, nil)
+}
+
+// NewTLSClientPool is NewClientPool with the connections to the ACS over TLS, see
+// TLSConfig.Load. A nil tlsConfig dials plain TCP.
+func NewTLSClientPool(host string, port, poolSize, timeout, retryTimes int, errorDetection bool, tlsConfig *tls.Config) (*ClientPool, error) {
+	conns := make(chan net.Conn, poolSize)
 	for i := 0; i < poolSize; i++ {
-		conn, err := newConn(host, port)
+		conn, err := newConn(host, port, timeout, tlsConfig)
 		if err != nil {
+			close(conns)
+			for c := range conns {
+				c.Close()
+			}
 			return nil, err
 		}
-		conns = append(conns, conn)
+		conns <- conn
 	}
-	return &ClientPool{uint64(poolSize), 0, conns, host, port, timeout, retryTimes, errorDetection}, nil
+	return &ClientPool{
+		length:         uint64(poolSize),
+		conns:          conns,
+		closed:         make(chan struct{}),
+		host:           host,
+		port:           port,
+		tlsConfig:      tlsConfig,
+		timeout:        timeout,
+		retryTimes:     retryTimes,
+		errorDetection: errorDetection,
+		metrics:        newMetrics(poolSize),
+		logger:         nopLogger{},
+		tracer:         noopTracer{},
+		sessions:       make(map[string]patronSession),
+	}, nil
 }
 
-func (p *ClientPool) Pop() *net.TCPConn {
-	currIndex := atomic.AddUint64(&(p.index), uint64(1))
-	slicePos := (currIndex - 1) % p.length
-	slotPointer := (*unsafe.Pointer)(unsafe.Pointer(&(p.conns[slicePos])))
-	for {
-		connPointer := atomic.SwapPointer(slotPointer, unsafe.Pointer((*net.TCPConn)(nil)))
-		if connPointer == nil {
-			runtime.Gosched()
-			continue
+// SetRecorder makes the pool write every frame it sends or reads to r, it should be
+// called before the pool is in use.
+func (p *ClientPool) SetRecorder(r *Recorder) {
+	p.recorder = r
+}
+
+// SetLogger makes the pool log to l: the broken connections and the resends as warnings,
+// the frames at debug level with their personal data redacted, see RedactFrame and
+// SetFrameDebug. It should be called before the pool is in use.
+func (p *ClientPool) SetLogger(l Logger) {
+	p.logger = l
+}
+
+// SetFrameDebug logs the full frames of the exchanges of the given methods of the JSON API,
+// and of their responses. It should be called before the pool is in use.
+func (p *ClientPool) SetFrameDebug(methods ...string) error {
+	frameDebug := make(map[string]bool)
+	for _, method := range methods {
+		newRequest, ok := MethodMap[method]
+		if !ok {
+			return fmt.Errorf("*ClientPool.SetFrameDebug: unknown method %s", method)
 		}
-		conn := (*net.TCPConn)(connPointer)
-		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(p.timeout)))
-		return conn
+		frameDebug[commandID(newRequest())] = true
 	}
+	p.frameDebug = frameDebug
+	return nil
 }
 
-func (p *ClientPool) Push(conn *net.TCPConn) {
-	currIndex := atomic.AddUint64(&(p.index), uint64(1<<64-1))
-	slicePos := currIndex % p.length
-	slotPointer := (*unsafe.Pointer)(unsafe.Pointer(&(p.conns[slicePos])))
-	for {
-		ok := atomic.CompareAndSwapPointer(slotPointer, unsafe.Pointer((*net.TCPConn)(nil)), unsafe.Pointer(conn))
-		if !ok {
-			runtime.Gosched()
-			continue
+// commandID is the command id of a request.
+func commandID(req interface{}) string {
+	return stringField(reflect.ValueOf(req).Elem(), "CommandID")
+}
+
+// Login logs every pooled connection in to the ACS, the connections opened later to replace
+// a broken one are logged in too. It should be called before the pool is in use.
+func (p *ClientPool) Login(userID, password, locationCode string) error {
+	req := NewLoginRequest()
+	*req.LoginUserID.StrValue = StrValue(userID)
+	*req.LoginPassword.StrValue = StrValue(password)
+	*req.LocationCode.StrValue = StrValue(locationCode)
+	p.login = req
+	conns := make([]net.Conn, 0, p.length)
+	var err error
+	for i := uint64(0); i < p.length && err == nil; i++ {
+		var conn net.Conn
+		conn, err = p.Pop(context.Background())
+		if err == nil {
+			conns = append(conns, conn)
+		}
+	}
+	for _, conn := range conns {
+		if err == nil {
+			err = p.loginConn(context.Background(), conn)
+		}
+		p.Push(conn)
+	}
+	return err
+}
+
+func (p *ClientPool) loginConn(ctx context.Context, conn net.Conn) (err error) {
+	_, span := startSpan(p.tracer, ctx, "sip2.login")
+	start := time.Now()
+	var resp interface{}
+	defer func() {
+		endSpan(span, err)
+		if resp != nil {
+			p.auditExchange(ctx, start, p.login, resp, nil)
+		} else {
+			p.auditExchange(ctx, start, p.login, nil, classifyError(err))
 		}
+	}()
+	seq := int(atomic.AddUint64(&(p.seq), 1) % 10)
+	b, _ := EncodeRequestSeq(p.login, seq)
+	conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
+	_, err = conn.Write(b)
+	if err != nil {
+		return err
+	}
+	p.record(conn, DirectionRequest, b)
+	p.logFrame(DirectionRequest, b, false)
+	bResp, err := p.readFrame(conn, seq, false)
+	if err != nil {
+		return err
+	}
+	resp, err = p.DecodeResponse(bResp)
+	if err != nil {
+		return err
+	}
+	if r, ok := resp.(*LoginResponse); !ok || !bool(*r.OK.BoolValue) {
+		return errors.New("*ClientPool.Login: login refused")
+	}
+	return nil
+}
+
+// SetEndSessionsOnClose makes Close send an End Patron Session for every patron session
+// still open, it should be called before the pool is in use. The sessions are tracked by
+// institution and patron id only, the ones idle for 10 minutes are not ended.
+func (p *ClientPool) SetEndSessionsOnClose(enabled bool) {
+	p.endSessions = enabled
+}
+
+// logFrame logs a frame at debug level, redacted unless full is set.
+func (p *ClientPool) logFrame(direction string, frame []byte, full bool) {
+	if _, ok := p.logger.(nopLogger); ok {
 		return
 	}
+	if !full {
+		frame = RedactFrame(frame)
+	}
+	p.logger.Log(LevelDebug, "frame", F("direction", direction), F("frame", strings.TrimRight(string(frame), "\r\n")))
 }
 
-func ReadResponse(conn *net.TCPConn) ([]byte, error) {
+func (p *ClientPool) record(conn net.Conn, direction string, frame []byte) {
+	if p.recorder == nil {
+		return
+	}
+	p.recorder.Record(conn.LocalAddr().String(), direction, frame)
+}
+
+// Pop takes an idle connection of the pool, waiting for one to be put back until ctx is
+// done. It fails with an ErrACSUnavailable error once Close has closed the pool, the ones
+// waiting then included.
+func (p *ClientPool) Pop(ctx context.Context) (net.Conn, error) {
+	atomic.AddInt64(&(p.metrics.waiting), 1)
+	defer atomic.AddInt64(&(p.metrics.waiting), -1)
+	select {
+	case <-p.closed:
+		return nil, errPoolClosed
+	default:
+	}
+	select {
+	case conn := <-p.conns:
+		atomic.AddInt64(&(p.metrics.inUse), 1)
+		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(p.timeout)))
+		return conn, nil
+	case <-p.closed:
+		return nil, errPoolClosed
+	case <-ctx.Done():
+		return nil, newError(ErrTimeout, "Pop: no idle connection: "+ctx.Err().Error())
+	}
+}
+
+// Push returns a connection taken by Pop to the pool.
+func (p *ClientPool) Push(conn net.Conn) {
+	atomic.AddInt64(&(p.metrics.inUse), -1)
+	select {
+	case p.conns <- conn:
+	default:
+		// not a connection of the pool
+		conn.Close()
+	}
+}
+
+// ReadResponse reads a byte at a time so that a frame already queued behind the
+// current one (a duplicated response) is left on the wire for the next read.
+func ReadResponse(conn net.Conn) ([]byte, error) {
 	content := make([]byte, 0, 1024)
-	buffer := make([]byte, 128)
-	var n int
-	var err error
+	buffer := make([]byte, 1)
 	for {
-		n, err = conn.Read(buffer)
+		n, err := conn.Read(buffer)
 		if err != nil {
 			return content, err
 		}
-		content = append(content, buffer[:n]...)
-		for _, b := range buffer[:n] {
-			if b == '\n' {
-				return content, nil
-			}
+		if n == 0 {
+			continue
+		}
+		content = append(content, buffer[0])
+		if buffer[0] == '\n' {
+			return content, nil
 		}
 	}
 }
 
-func (p *ClientPool) ReliableCommunicate(req interface{}) (interface{}, error) {
-	b, err := EncodeRequest(req)
-	if err != nil {
-		return nil, err
-	}
-	conn := p.Pop()
-	defer p.Push(conn)
-	var bResp, zero []byte
-OUTER_WRITE:
-	for i := 0; i < p.retryTimes; i++ {
-		_, err = conn.Read(zero)
+var errCorrupted = errors.New("ReliableCommunicate: corrupted response")
+
+// readFrame skips the frames carrying another sequence number, they are late or
+// duplicated responses to an earlier request on this connection. The frames are logged in
+// full when full is set, a corrupted frame is returned with errCorrupted.
+func (p *ClientPool) readFrame(conn net.Conn, seq int, full bool) ([]byte, error) {
+	for {
+		bResp, err := ReadResponse(conn)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
-				conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
-				continue OUTER_WRITE
-			} else {
-				var newErr error
-				conn.Close()
-				for {
-					conn, newErr = newConn(p.host, p.port)
-					if newErr == nil {
-						conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
-						continue OUTER_WRITE
-					}
-				}
-			}
+			return nil, err
 		}
-		_, err = conn.Write(b)
+		p.record(conn, DirectionResponse, bResp)
+		p.logFrame(DirectionResponse, bResp, full)
+		_, respSeq, err := ParseFrame(bResp, p.errorDetection)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
-				conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
-				continue OUTER_WRITE
-			} else {
-				var newErr error
-				conn.Close()
-				for {
-					conn, newErr = newConn(p.host, p.port)
-					if newErr == nil {
-						conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
-						continue OUTER_WRITE
-					}
-				}
-			}
+			atomic.AddUint64(&(p.metrics.checksumFailures), 1)
+			return bResp, errCorrupted
 		}
-		break OUTER_WRITE
+		if respSeq >= 0 && respSeq != seq {
+			continue
+		}
+		return bResp, nil
 	}
+}
+
+// ReliableCommunicate sends the request and reads its response, within retryTimes attempts:
+// a broken or timed out connection is replaced by a new one and the request is written again,
+// a corrupted response is asked again with a 97 and a 96 from the ACS makes the request resent.
+func (p *ClientPool) ReliableCommunicate(req interface{}) (interface{}, error) {
+	return p.ReliableCommunicateContext(context.Background(), req)
+}
+
+// ReliableCommunicateContext is ReliableCommunicate with ctx given to the interceptors.
+func (p *ClientPool) ReliableCommunicateContext(ctx context.Context, req interface{}) (interface{}, error) {
+	err := p.acquire()
 	if err != nil {
 		return nil, err
 	}
-OUTER_READ:
-	for i := 0; i < p.retryTimes; i++ {
-		bResp, err = ReadResponse(conn)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
-				conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
-				continue OUTER_READ
-			} else {
-				var newErr error
-				conn.Close()
-				for {
-					conn, newErr = newConn(p.host, p.port)
-					if newErr == nil {
-						return nil, err
-					}
-				}
+	defer p.release()
+	resp, err := p.intercept(ctx, req, p.communicate)
+	if err == nil {
+		p.trackSession(req)
+	}
+	return resp, err
+}
+
+// acquire counts an exchange in flight, it fails once Close has been called.
+func (p *ClientPool) acquire() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		return errPoolClosed
+	}
+	p.inFlight++
+	return nil
+}
+
+func (p *ClientPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	if p.inFlight == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// trackSession keeps the patron sessions open for Close when SetEndSessionsOnClose is set,
+// the sessions idle for sessionIdleTTL are dropped and at most maxSessions are kept.
+func (p *ClientPool) trackSession(req interface{}) {
+	if !p.endSessions {
+		return
+	}
+	val := reflect.ValueOf(req).Elem()
+	now := time.Now()
+	session := patronSession{
+		institutionID: stringField(val, "InstitutionID"),
+		patronID:      stringField(val, "PatronID"),
+		seen:          now,
+	}
+	if session.patronID == "" {
+		return
+	}
+	key := session.institutionID + "|" + session.patronID
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := req.(*EndPatronSessionRequest); ok {
+		delete(p.sessions, key)
+		return
+	}
+	if _, ok := p.sessions[key]; !ok && len(p.sessions) >= maxSessions {
+		oldest := ""
+		for k, s := range p.sessions {
+			if now.Sub(s.seen) > sessionIdleTTL {
+				delete(p.sessions, k)
+			} else if oldest == "" || s.seen.Before(p.sessions[oldest].seen) {
+				oldest = k
 			}
 		}
-		break OUTER_READ
+		if len(p.sessions) >= maxSessions {
+			delete(p.sessions, oldest)
+		}
 	}
+	p.sessions[key] = session
+}
+
+// stringField returns the value of a string field of a request, "" when it has no such field.
+func stringField(val reflect.Value, name string) string {
+	field := val.FieldByName(name)
+	if !field.IsValid() || field.Field(0).IsNil() {
+		return ""
+	}
+	sv, ok := field.Field(0).Interface().(*StrValue)
+	if !ok {
+		return ""
+	}
+	return string(*sv)
+}
+
+// Sequence runs fn with one pooled connection to itself, every request given to send is
+// exchanged on it in turn, with the retries of ReliableCommunicate.
+func (p *ClientPool) Sequence(fn func(send func(req interface{}) (interface{}, error)) error) error {
+	return p.SequenceContext(context.Background(), fn)
+}
+
+// SequenceContext is Sequence with ctx given to the interceptors and the tracer.
+func (p *ClientPool) SequenceContext(ctx context.Context, fn func(send func(req interface{}) (interface{}, error)) error) error {
+	err := p.acquire()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer p.release()
+	conn, err := p.pop(ctx)
+	if err != nil {
+		return err
 	}
-	fmt.Println(string(bResp))
-	resp, err := p.DecodeResponse(bResp)
+	defer func() {
+		p.putBack(conn)
+	}()
+	return fn(func(req interface{}) (interface{}, error) {
+		resp, err := p.intercept(ctx, req, func(ctx context.Context, req interface{}, frames *Frames) (interface{}, error) {
+			return p.exchange(ctx, &conn, req, frames)
+		})
+		if err == nil {
+			p.trackSession(req)
+		}
+		return resp, err
+	})
+}
+
+func (p *ClientPool) communicate(ctx context.Context, req interface{}, frames *Frames) (interface{}, error) {
+	conn, err := p.pop(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if _, ok := resp.(*ResendRequest); ok {
-		goto OUTER_WRITE
+	defer func() {
+		p.putBack(conn)
+	}()
+	return p.exchange(ctx, &conn, req, frames)
+}
+
+// pop is Pop in a pool wait span.
+func (p *ClientPool) pop(ctx context.Context) (conn net.Conn, err error) {
+	_, span := startSpan(p.tracer, ctx, "sip2.pool_wait")
+	defer func() {
+		endSpan(span, err)
+	}()
+	return p.Pop(ctx)
+}
+
+// exchange replaces *conn by a new connection when it breaks, the frames are added to frames
+// when not nil. Every attempt is a span.
+func (p *ClientPool) exchange(ctx context.Context, connp *net.Conn, req interface{}, frames *Frames) (resp interface{}, err error) {
+	start := time.Now()
+	defer func() {
+		p.metrics.observeExchange(req, resp, err, time.Since(start))
+	}()
+	conn := *connp
+	defer func() {
+		*connp = conn
+	}()
+	seq := int(atomic.AddUint64(&(p.seq), 1) % 10)
+	b, _ := EncodeRequestSeq(req, seq)
+	full := p.frameDebug[commandID(req)]
+	resend := BuildFrame([]byte("97"), -1)
+	out := b
+	broken := false
+	attempts := p.retryTimes
+	if attempts < 1 {
+		attempts = 1
 	}
-	return resp, nil
+	var attempt Span = noopSpan{}
+	defer func() {
+		endSpan(attempt, err)
+	}()
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			atomic.AddUint64(&(p.metrics.retries), 1)
+		}
+		endSpan(attempt, err)
+		var attemptCtx context.Context
+		attemptCtx, attempt = startSpan(p.tracer, ctx, "sip2.attempt")
+		attempt.SetAttribute("sip2.attempt", i+1)
+		if broken {
+			var newC net.Conn
+			_, dial := startSpan(p.tracer, attemptCtx, "sip2.dial")
+			newC, err = newConn(p.host, p.port, p.timeout, p.tlsConfig)
+			endSpan(dial, err)
+			if err != nil {
+				p.logger.Log(LevelWarn, "cannot reconnect to the ACS", F("attempt", i+1), F("error", err))
+				continue
+			}
+			if p.login != nil {
+				err = p.loginConn(attemptCtx, newC)
+				if err != nil {
+					p.logger.Log(LevelWarn, "cannot log in to the ACS", F("attempt", i+1), F("error", err))
+					newC.Close()
+					continue
+				}
+			}
+			atomic.AddUint64(&(p.metrics.reconnects), 1)
+			conn, broken, out = newC, false, b
+		}
+		conn.SetDeadline(time.Now().Add(time.Duration(p.timeout) * time.Second))
+		_, write := startSpan(p.tracer, attemptCtx, "sip2.write")
+		_, err = conn.Write(out)
+		endSpan(write, err)
+		if err != nil {
+			p.logger.Log(LevelWarn, "ACS connection broken", F("attempt", i+1), F("error", err))
+			conn.Close()
+			broken = true
+			continue
+		}
+		p.record(conn, DirectionRequest, out)
+		p.logFrame(DirectionRequest, out, full)
+		frames.add(DirectionRequest, out)
+		var bResp []byte
+		_, read := startSpan(p.tracer, attemptCtx, "sip2.read")
+		bResp, err = p.readFrame(conn, seq, full)
+		endSpan(read, err)
+		if bResp != nil {
+			frames.add(DirectionResponse, bResp)
+		}
+		if err == errCorrupted {
+			atomic.AddUint64(&(p.metrics.resends), 1)
+			p.logger.Log(LevelWarn, "corrupted response, asking a resend", F("attempt", i+1))
+			out = resend
+			continue
+		}
+		if err != nil {
+			p.logger.Log(LevelWarn, "ACS connection broken", F("attempt", i+1), F("error", err))
+			conn.Close()
+			broken = true
+			continue
+		}
+		_, decode := startSpan(p.tracer, attemptCtx, "sip2.decode")
+		resp, err = p.DecodeResponse(bResp)
+		endSpan(decode, err)
+		if err != nil {
+			return nil, newError(ErrProtocol, err.Error())
+		}
+		if _, ok := resp.(*RequestSCResendResponse); ok {
+			atomic.AddUint64(&(p.metrics.acsResends), 1)
+			p.logger.Log(LevelWarn, "ACS requested a resend", F("attempt", i+1))
+			resp, out = nil, b
+			err = newError(ErrProtocol, "ReliableCommunicate: ACS requested resend")
+			continue
+		}
+		return resp, nil
+	}
+	return nil, classifyError(err)
 }
 
 // func (p *ClientPool) ReliableCommunicate(req interface{}, ctx context.Context) (interface{}, error) {
@@ -270,18 +645,101 @@ OUTER_READ:
 // 	return resp, nil
 // }
 
-func (p *ClientPool) Close(ctx context.Context) error {
-	var closedNum uint64
+// putBack returns a connection to the pool, or closes it when Close has already swept the
+// pool. Close sets swept before sweeping, so either of them gets a connection pushed meanwhile.
+func (p *ClientPool) putBack(conn net.Conn) {
+	p.Push(conn)
+	if atomic.LoadInt32(&(p.swept)) == 1 {
+		p.sweep()
+	}
+}
+
+func (p *ClientPool) sweep() []error {
+	var errs []error
 	for {
 		select {
-		case <-ctx.Done():
-			return errors.New("*ClientPool.Close: close error")
-		default:
-			p.Pop().Close()
-			closedNum += 1
-			if closedNum == p.length {
-				return nil
+		case conn := <-p.conns:
+			err := conn.Close()
+			if err != nil {
+				errs = append(errs, err)
 			}
+		default:
+			return errs
+		}
+	}
+}
+
+// Close refuses new exchanges, waits for the ones in flight, ends the open patron sessions
+// when SetEndSessionsOnClose is set, and closes the connections. When ctx is done before the
+// exchanges in flight end, the idle connections are closed and the others are closed as they
+// are put back.
+func (p *ClientPool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closing = true
+	var idle chan struct{}
+	if p.inFlight > 0 {
+		if p.idle == nil {
+			p.idle = make(chan struct{})
+		}
+		idle = p.idle
+	}
+	p.mu.Unlock()
+	var errs []error
+	drained := true
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			drained = false
+			errs = append(errs, fmt.Errorf("*ClientPool.Close: %d exchanges in flight: %s", p.inFlightCount(), ctx.Err()))
+		}
+	}
+	if drained && p.endSessions {
+		errs = append(errs, p.endOpenSessions(ctx)...)
+	}
+	atomic.StoreInt32(&(p.swept), 1)
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	errs = append(errs, p.sweep()...)
+	return joinErrors(errs)
+}
+
+func (p *ClientPool) inFlightCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inFlight
+}
+
+func (p *ClientPool) endOpenSessions(ctx context.Context) []error {
+	p.mu.Lock()
+	sessions := make([]patronSession, 0, len(p.sessions))
+	for key, session := range p.sessions {
+		sessions = append(sessions, session)
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	var errs []error
+	now := time.Now()
+	for _, session := range sessions {
+		if now.Sub(session.seen) > sessionIdleTTL {
+			sessions = sessions[1:]
+			continue
+		}
+		if ctx.Err() != nil {
+			return append(errs, fmt.Errorf("*ClientPool.Close: %d patron sessions not ended: %s", len(sessions), ctx.Err()))
+		}
+		req := NewEndPatronSessionRequest()
+		*req.TransactionDate.TimeValue = TimeValue(time.Now())
+		*req.InstitutionID.StrValue = StrValue(session.institutionID)
+		*req.PatronID.StrValue = StrValue(session.patronID)
+		start := time.Now()
+		resp, err := p.communicate(ctx, req, nil)
+		p.auditExchange(ctx, start, req, resp, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("*ClientPool.Close: end session of %s: %s", session.patronID, err))
 		}
+		sessions = sessions[1:]
 	}
+	return errs
 }
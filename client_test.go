@@ -1,23 +1,511 @@
-package sip2
-
-// func TestRequest(t *testing.T) {
-// 	pool, err := NewClientPool("112.230.195.36", 2030, 20, 10, 5, true)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	patronStatus, err := pool.QueryPatronStatus(Chinese, "", "", "", "")
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	b, err := json.Marshal(patronStatus)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	fmt.Printf("%#v\n", string(b))
-// 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-// 	defer cancel()
-// 	err = pool.Close(ctx)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// }
+package sip2_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sip2"
+	"sip2/sip2test"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startMockACS(t *testing.T) *sip2test.MockACS {
+	fixtures, err := sip2test.LoadFixtures("sip2test/testdata/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs, err := sip2test.StartMockACS(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { acs.Close() })
+	return acs
+}
+
+func newMockPool(t *testing.T, acs *sip2test.MockACS) *sip2.ClientPool {
+	pool, err := acs.NewClientPool(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		pool.Close(ctx)
+	})
+	return pool
+}
+
+func TestRequest(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	req := sip2.NewPatronStatusRequest()
+	*req.Language.IntValue = sip2.IntValue(sip2.Chinese)
+	*req.PatronID.StrValue = "P001"
+	*req.PatronPassword.StrValue = "1234"
+	resp, err := pool.ReliableCommunicate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patronStatus := resp.(*sip2.PatronStatusResponse)
+	if !*patronStatus.ValidPatron.BoolValue || !*patronStatus.ValidPatronPassword.BoolValue {
+		t.Fatal("expected a valid patron")
+	}
+	if *patronStatus.PersonalName.StrValue != "Alice Reader" {
+		t.Fatalf("unexpected personal name: %s", *patronStatus.PersonalName.StrValue)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	acs := startMockACS(t)
+	pool := newMockPool(t, acs)
+	err := pool.Login("kiosk1", "wrong password", "hall")
+	if err == nil {
+		t.Fatal("login with a wrong password accepted")
+	}
+	err = pool.Login("kiosk1", "kiosk password", "hall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = patronStatus(pool, "P001")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCirculation(t *testing.T) {
+	acs := startMockACS(t)
+	pool := newMockPool(t, acs)
+	checkout := func(patronID, itemID string) *sip2.CheckoutResponse {
+		req := sip2.NewCheckoutRequest()
+		*req.PatronID.StrValue = sip2.StrValue(patronID)
+		*req.ItemID.StrValue = sip2.StrValue(itemID)
+		resp, err := pool.ReliableCommunicate(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.(*sip2.CheckoutResponse)
+	}
+	if resp := checkout("P001", "I001"); !*resp.OK.BoolValue {
+		t.Fatalf("checkout refused: %s", *resp.ScreenMessage.StrValue)
+	}
+	if loan, ok := acs.Loan("I001"); !ok || loan.PatronID != "P001" {
+		t.Fatalf("loan not recorded: %+v", loan)
+	}
+	if resp := checkout("P002", "I001"); *resp.OK.BoolValue {
+		t.Fatal("checked out an item already charged")
+	}
+	if resp := checkout("P002", "I004"); *resp.OK.BoolValue {
+		t.Fatal("checked out an item on hold for another patron")
+	}
+	if resp := checkout("P003", "I002"); *resp.OK.BoolValue {
+		t.Fatal("checked out to a blocked patron")
+	}
+	checkin := sip2.NewCheckinRequest()
+	*checkin.ItemID.StrValue = "I001"
+	resp, err := pool.ReliableCommunicate(checkin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkinResp := resp.(*sip2.CheckinResponse); !*checkinResp.OK.BoolValue || *checkinResp.PatronID.StrValue != "P001" {
+		t.Fatal("unexpected checkin response")
+	}
+	if _, ok := acs.Loan("I001"); ok {
+		t.Fatal("loan not removed on checkin")
+	}
+	feePaid := sip2.NewFeePaidRequest()
+	*feePaid.PatronID.StrValue = "P002"
+	*feePaid.FeeID.StrValue = "F001"
+	*feePaid.FeeAmount.FloatValue = 2.5
+	resp, err = pool.ReliableCommunicate(feePaid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*resp.(*sip2.FeePaidResponse).PaymentAccepted.BoolValue || acs.Fees("P002") != 0 {
+		t.Fatal("fee not paid")
+	}
+}
+
+func newFaultPool(t *testing.T, steps ...sip2test.FaultStep) (*sip2.ClientPool, *sip2test.FaultProxy) {
+	acs := startMockACS(t)
+	proxy, err := sip2test.StartFaultProxy(acs.Host(), acs.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	proxy.Inject(steps...)
+	pool, err := sip2.NewClientPool(proxy.Host(), proxy.Port(), 1, 1, 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, proxy
+}
+
+func patronStatus(pool *sip2.ClientPool, patronID string) (*sip2.PatronStatusResponse, error) {
+	req := sip2.NewPatronStatusRequest()
+	*req.PatronID.StrValue = sip2.StrValue(patronID)
+	resp, err := pool.ReliableCommunicate(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*sip2.PatronStatusResponse), nil
+}
+
+func TestReliableCommunicateFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []sip2test.FaultStep
+		frames int
+		fail   bool
+	}{
+		{"latency", []sip2test.FaultStep{{Fault: sip2test.Pass, Latency: 100 * time.Millisecond}}, 1, false},
+		{"timeout", []sip2test.FaultStep{{Fault: sip2test.Pass, Latency: 1500 * time.Millisecond}}, 2, false},
+		{"drop", []sip2test.FaultStep{{Fault: sip2test.Drop}}, 2, false},
+		{"half write", []sip2test.FaultStep{{Fault: sip2test.HalfWrite}}, 2, false},
+		{"corrupt checksum", []sip2test.FaultStep{{Fault: sip2test.CorruptChecksum}}, 2, false},
+		{"corrupt request", []sip2test.FaultStep{{Fault: sip2test.CorruptRequest}}, 2, false},
+		{"stall", []sip2test.FaultStep{{Fault: sip2test.Stall}}, 2, false},
+		{"retries exhausted", []sip2test.FaultStep{{Fault: sip2test.Drop}, {Fault: sip2test.Drop}, {Fault: sip2test.Drop}}, 3, true},
+		{"invalid command", []sip2test.FaultStep{{Fault: sip2test.InvalidCommand}}, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool, proxy := newFaultPool(t, test.steps...)
+			resp, err := patronStatus(pool, "P001")
+			if test.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *resp.PatronID.StrValue != "P001" {
+					t.Fatalf("unexpected patron id: %s", *resp.PatronID.StrValue)
+				}
+			}
+			if frames := proxy.Frames(); len(frames) != test.frames {
+				t.Fatalf("expected %d frames, got %d: %q", test.frames, len(frames), frames)
+			}
+		})
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	pool, _ := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.InvalidCommand, Latency: 300 * time.Millisecond})
+	start := time.Now()
+	if _, err := patronStatus(pool, "P001"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("fault answered after %s, before the latency", elapsed)
+	}
+}
+
+func TestReliableCommunicateResend(t *testing.T) {
+	pool, proxy := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.CorruptChecksum})
+	_, err := patronStatus(pool, "P001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := proxy.Frames(); frames[1][:2] != "97" {
+		t.Fatalf("expected a resend request, got %q", frames[1])
+	}
+}
+
+func TestLogger(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	var buffer bytes.Buffer
+	pool.SetLogger(sip2.NewTextLogger(&buffer, sip2.LevelDebug))
+	patronInformation := func() {
+		req := sip2.NewPatronInformationRequest()
+		sip2.SetField(req, "patron_id", "P001")
+		sip2.SetField(req, "patron_password", "1234")
+		if _, err := pool.ReliableCommunicate(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patronInformation()
+	logged := buffer.String()
+	for _, secret := range []string{"AD1234", "Alice Reader", "alice@example.com", "1 Library Road", "555-0001"} {
+		if strings.Contains(logged, secret) {
+			t.Fatalf("%q not redacted:\n%s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "level=debug msg=frame direction=response") || !strings.Contains(logged, "AE***|") {
+		t.Fatalf("unexpected log:\n%s", logged)
+	}
+	if err := pool.SetFrameDebug("no_such_method"); err == nil {
+		t.Fatal("unknown method accepted")
+	}
+	if err := pool.SetFrameDebug("query_patron_information"); err != nil {
+		t.Fatal(err)
+	}
+	buffer.Reset()
+	patronInformation()
+	if !strings.Contains(buffer.String(), "AEAlice Reader|") {
+		t.Fatalf("full frame not logged:\n%s", buffer.String())
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	var calls []string
+	var frames *sip2.Frames
+	pool.SetInterceptors(
+		func(ctx context.Context, req interface{}, next sip2.Invoker) (interface{}, error) {
+			calls = append(calls, "outer")
+			resp, err := next(ctx, req)
+			frames = sip2.FramesFromContext(ctx)
+			return resp, err
+		},
+		func(ctx context.Context, req interface{}, next sip2.Invoker) (interface{}, error) {
+			calls = append(calls, "inner")
+			if r, ok := req.(*sip2.PatronStatusRequest); ok && *r.PatronID.StrValue == "blocked" {
+				return nil, errors.New("refused by interceptor")
+			}
+			return next(ctx, req)
+		},
+	)
+	resp, err := patronStatus(pool, "P001")
+	if err != nil || *resp.PatronID.StrValue != "P001" {
+		t.Fatalf("unexpected response: %v %+v", err, resp)
+	}
+	if strings.Join(calls, ",") != "outer,inner" {
+		t.Fatalf("unexpected order: %v", calls)
+	}
+	if len(frames.Sent) != 1 || string(frames.Sent[0][:2]) != "23" || len(frames.Received) != 1 || string(frames.Received[0][:2]) != "24" {
+		t.Fatalf("unexpected frames: %q %q", frames.Sent, frames.Received)
+	}
+	if _, err = patronStatus(pool, "blocked"); err == nil || err.Error() != "refused by interceptor" {
+		t.Fatalf("not short-circuited: %v", err)
+	}
+	if len(frames.Sent) != 0 {
+		t.Fatalf("frames sent after a short-circuit: %q", frames.Sent)
+	}
+}
+
+func TestReliableCommunicateDuplicate(t *testing.T) {
+	pool, _ := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Duplicate})
+	for _, patronID := range []string{"P001", "P002"} {
+		resp, err := patronStatus(pool, patronID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(*resp.PatronID.StrValue) != patronID {
+			t.Fatalf("got the response of %s for %s", *resp.PatronID.StrValue, patronID)
+		}
+	}
+}
+
+func TestReliableCommunicateACSDown(t *testing.T) {
+	pool, proxy := newFaultPool(t)
+	proxy.Close()
+	_, err := patronStatus(pool, "P001")
+	if !errors.Is(err, sip2.ErrACSUnavailable) {
+		t.Fatalf("expected ErrACSUnavailable, got %v", err)
+	}
+}
+
+func TestCloseDrain(t *testing.T) {
+	pool, proxy := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Pass, Latency: 500 * time.Millisecond})
+	pool.SetEndSessionsOnClose(true)
+	done := make(chan error, 1)
+	go func() {
+		_, err := patronStatus(pool, "P001")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := pool.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("in-flight exchange failed: %s", err)
+	}
+	if _, err = patronStatus(pool, "P001"); err == nil {
+		t.Fatal("exchange accepted after Close")
+	}
+	frames := proxy.Frames()
+	if last := frames[len(frames)-1]; last[:2] != "35" {
+		t.Fatalf("expected an end patron session, got %q", frames)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	pool, _ := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Pass, Latency: 800 * time.Millisecond})
+	done := make(chan error, 1)
+	go func() {
+		_, err := patronStatus(pool, "P001")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := pool.Close(ctx); err == nil {
+		t.Fatal("expected a drain timeout")
+	}
+	<-done
+}
+
+func TestCloseWaiting(t *testing.T) {
+	pool, _ := newFaultPool(t)
+	conn, err := pool.Pop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = pool.Pop(ctx); !errors.Is(err, sip2.ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := patronStatus(pool, "P001")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer closeCancel()
+	pool.Close(closeCtx)
+	select {
+	case err = <-done:
+		if !errors.Is(err, sip2.ErrACSUnavailable) {
+			t.Fatalf("expected ErrACSUnavailable, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("exchange waiting for a connection still blocked after Close")
+	}
+	pool.Push(conn)
+}
+
+// writeTestCerts writes a CA (ca.pem), a certificate for 127.0.0.1 (server.pem,
+// server-key.pem) and a client certificate of common name desk-1 (client.pem,
+// client-key.pem) signed by the CA in a temporary directory.
+func writeTestCerts(t *testing.T) string {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+	for i, name := range []string{"server", "client"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: "desk-1"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if name == "server" {
+			template.Subject.CommonName = "127.0.0.1"
+			template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+		writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+	}
+	return dir
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSRelay terminates TLS in front of the mock ACS.
+func startTLSRelay(t *testing.T, dir string, acs *sip2test.MockACS) (string, int) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", net.JoinHostPort(acs.Host(), strconv.Itoa(acs.Port())))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestTLSClientPool(t *testing.T) {
+	dir := writeTestCerts(t)
+	host, port := startTLSRelay(t, dir, startMockACS(t))
+	cfg := &sip2.TLSConfig{CAFile: filepath.Join(dir, "ca.pem"), MinVersion: "1.2"}
+	tlsConfig, err := cfg.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := sip2.NewTLSClientPool(host, port, 1, 5, 3, true, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+	resp, err := patronStatus(pool, "P001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bool(*resp.ValidPatron.BoolValue) {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	// the system roots do not know the test CA
+	if _, err = sip2.NewTLSClientPool(host, port, 1, 5, 3, true, &tls.Config{}); err == nil {
+		t.Fatal("connected to an untrusted ACS")
+	}
+}
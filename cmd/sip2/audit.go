@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sip2"
+	"time"
+)
+
+// audit prints the records of an audit log and of its rotated files matching the filters.
+func audit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	patronID := flags.String("patron", "", "only the records of this patron id")
+	itemID := flags.String("item", "", "only the records of this item id")
+	from := flags.String("from", "", "only the records from this date, 2006-01-02 or RFC 3339")
+	to := flags.String("to", "", "only the records before this date, 2006-01-02 or RFC 3339")
+	jsonOutput := flags.Bool("json", false, "print a JSON object per record")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sip2 audit [-patron id] [-item id] [-from date] [-to date] [-json] file")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	filter := sip2.AuditFilter{PatronID: *patronID, ItemID: *itemID}
+	var err error
+	if filter.From, err = parseDate(*from); err != nil {
+		return err
+	}
+	if filter.To, err = parseDate(*to); err != nil {
+		return err
+	}
+	records, err := sip2.QueryAudit(flags.Arg(0), filter)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, rec := range records {
+		if *jsonOutput {
+			encoder.Encode(rec)
+			continue
+		}
+		fmt.Printf("%s %-16s %-24s patron=%s item=%s %s %.1fms", rec.Time.Format(time.RFC3339), rec.Client, rec.Method, rec.PatronID, rec.ItemID, rec.Outcome, rec.LatencyMS)
+		if rec.Message != "" {
+			fmt.Printf(" %q", rec.Message)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// parseDate reads a date in local time or an RFC 3339 time, empty is the zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("audit: %q is neither 2006-01-02 nor RFC 3339", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sip2"
+	"strings"
+)
+
+// decode prints the frames given as arguments, or read line by line from the standard input.
+func decode(args []string) error {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print a JSON object per frame")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sip2 decode [-json] [frame ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	encoder := json.NewEncoder(os.Stdout)
+	print := func(frame string) {
+		frame = strings.TrimRight(frame, "\r\n")
+		if frame == "" {
+			return
+		}
+		if *jsonOutput {
+			encoder.Encode(sip2.Dissect([]byte(frame)))
+			return
+		}
+		fmt.Println(sip2.FormatFrame([]byte(frame)))
+	}
+	if flags.NArg() > 0 {
+		for _, frame := range flags.Args() {
+			print(frame)
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		print(scanner.Text())
+	}
+	return scanner.Err()
+}
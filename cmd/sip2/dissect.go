@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sip2"
+	"sip2/pcap"
+	"strconv"
+	"strings"
+)
+
+type dissectedMessage struct {
+	pcap.Message
+	Frame string `json:"frame"`
+	*sip2.Dissection
+}
+
+func dissect(args []string) error {
+	flags := flag.NewFlagSet("dissect", flag.ExitOnError)
+	ports := flags.String("ports", "6001", "comma separated SIP ports")
+	jsonOutput := flags.Bool("json", false, "print a JSON object per frame")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: sip2 dissect [-ports 6001] [-json] capture.pcap")
+	}
+	portList := make([]int, 0, 4)
+	for _, p := range strings.Split(*ports, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return fmt.Errorf("dissect: invalid port %q", p)
+		}
+		portList = append(portList, port)
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	messages, err := pcap.ReadMessages(f, portList...)
+	encoder := json.NewEncoder(os.Stdout)
+	for _, msg := range messages {
+		d := sip2.Dissect(msg.Frame)
+		if *jsonOutput {
+			encoder.Encode(dissectedMessage{msg, strings.TrimRight(string(msg.Frame), "\r\n"), d})
+			continue
+		}
+		printMessage(os.Stdout, msg, d)
+	}
+	return err
+}
+
+func printMessage(w io.Writer, msg pcap.Message, d *sip2.Dissection) {
+	direction := "ACS>SC"
+	if msg.FromSC {
+		direction = "SC>ACS"
+	}
+	fmt.Fprintf(w, "%s %s -> %s %s %s (%s) seq=%d checksum=%s\n", msg.Time.Format("2006-01-02 15:04:05.000000"),
+		msg.Src, msg.Dst, direction, d.Type, d.CommandID, d.Sequence, d.Checksum)
+	fmt.Fprintf(w, "  %s\n", strings.TrimRight(string(msg.Frame), "\r\n"))
+	if msg.Partial {
+		fmt.Fprintln(w, "  ! partial frame")
+	}
+	if d.Checksum == sip2.ChecksumBad {
+		fmt.Fprintln(w, "  ! checksum failure")
+	}
+	if len(d.UnknownFields) > 0 {
+		fmt.Fprintf(w, "  ! unknown fields: %s\n", strings.Join(d.UnknownFields, ", "))
+	}
+	if d.Error != "" {
+		fmt.Fprintf(w, "  ! %s\n", d.Error)
+	}
+}
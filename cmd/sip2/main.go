@@ -0,0 +1,38 @@
+// Command sip2 gathers the SIP2 troubleshooting tools.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: sip2 <command> [arguments]
+
+commands:
+  audit     list the records of a gateway audit log
+  decode    print the annotated breakdown of raw SIP2 frames
+  dissect   decode the SIP2 conversations of a pcap or pcapng capture
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "audit":
+		err = audit(os.Args[2:])
+	case "decode":
+		err = decode(os.Args[2:])
+	case "dissect":
+		err = dissect(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+// Command sip2ctl is an interactive SIP2 client for commissioning kiosks and reproducing ACS issues.
+// Every line is a method of the JSON API followed by field=value pairs, e.g.
+//
+//	sip2ctl -host 10.0.0.9 -port 6001 -login kiosk:secret -location hall -institution lib
+//	sip2> checkout patron=P001 item=I001
+//
+// The frames sent and read are printed before the decoded response. Lines are read from
+// a script file with -script, or from the standard input when it is not a terminal.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sip2"
+	"strings"
+)
+
+func main() {
+	host := flag.String("host", "127.0.0.1", "ACS host")
+	port := flag.Int("port", 6001, "ACS port")
+	timeout := flag.Int("timeout", 10, "timeout in seconds")
+	retries := flag.Int("retries", 3, "attempts per message")
+	errorDetection := flag.Bool("error-detection", true, "verify the checksum of the responses")
+	login := flag.String("login", "", "log in first as user:password")
+	location := flag.String("location", "", "location code of the login")
+	institution := flag.String("institution", "", "default institution_id")
+	terminalPassword := flag.String("terminal-password", "", "default terminal_password")
+	script := flag.String("script", "", "run the lines of a file instead of reading the standard input")
+	keepGoing := flag.Bool("keep-going", false, "do not stop a script at the first failure")
+	history := flag.String("history", defaultHistoryPath(), "history file, empty to disable")
+	auditPath := flag.String("audit", "", "append every exchange to this audit log")
+	flag.Parse()
+
+	pool, err := sip2.NewClientPool(*host, *port, 1, *timeout, *retries, *errorDetection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	pool.SetRecorder(sip2.NewRawRecorder(&frameWriter{w: os.Stdout}))
+	if *auditPath != "" {
+		auditLog, err := sip2.NewAuditLog(*auditPath, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+		pool.SetAudit(auditLog, "sip2ctl")
+	}
+	s := newShell(pool, os.Stdout)
+	if *institution != "" {
+		s.defaults["institution_id"] = *institution
+	}
+	if *terminalPassword != "" {
+		s.defaults["terminal_password"] = *terminalPassword
+	}
+	if *login != "" {
+		user, password := *login, ""
+		if i := strings.IndexByte(*login, ':'); i >= 0 {
+			user, password = (*login)[:i], (*login)[i+1:]
+		}
+		err = s.login(user, password, *location)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		err = s.runScript(f, *keepGoing)
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice == 0 {
+		err = s.runScript(os.Stdin, *keepGoing)
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	s.loadHistory(*history)
+	s.runInteractive(os.Stdin)
+}
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sip2ctl_history")
+}
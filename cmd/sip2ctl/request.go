@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sip2"
+	"strings"
+	"time"
+)
+
+var methodAliases = map[string]string{
+	"checkout": "check_out",
+	"checkin":  "check_in",
+	"status":   "query_sc_status",
+}
+
+// resolveMethod accepts the method names of the JSON API, a few aliases and the query
+// methods without their prefix (patron_status, item_information...).
+func resolveMethod(name string) (string, error) {
+	if _, ok := sip2.MethodMap[name]; ok {
+		return name, nil
+	}
+	if method, ok := methodAliases[name]; ok {
+		return method, nil
+	}
+	if _, ok := sip2.MethodMap["query_"+name]; ok {
+		return "query_" + name, nil
+	}
+	return "", fmt.Errorf("unknown method %s, see help", name)
+}
+
+func requestFields(method string) []string {
+	val := reflect.ValueOf(sip2.MethodMap[method]()).Elem()
+	fields := make([]string, 0, val.NumField())
+	for i := 0; i < val.NumField(); i++ {
+		if tag := jsonTag(val.Type().Field(i)); tag != "command_id" {
+			fields = append(fields, tag)
+		}
+	}
+	return fields
+}
+
+func jsonTag(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// buildRequest fills a request from field=value pairs, a field can be named without its
+// _id suffix (patron=P001). The defaults apply to the fields the request has, and the
+// transaction date is now unless given.
+func buildRequest(method string, values, defaults map[string]string) (interface{}, error) {
+	req := sip2.MethodMap[method]()
+	merged := make(map[string]string)
+	if sip2.HasField(req, "transaction_date") {
+		merged["transaction_date"] = time.Now().Format("2006-01-02 15:04:05")
+	}
+	for key, value := range defaults {
+		if sip2.HasField(req, key) {
+			merged[key] = value
+		}
+	}
+	for key, value := range values {
+		if !sip2.HasField(req, key) {
+			if !sip2.HasField(req, key+"_id") {
+				return nil, fmt.Errorf("%s has no field %s, fields: %s", method, key, strings.Join(requestFields(method), " "))
+			}
+			key += "_id"
+		}
+		merged[key] = value
+	}
+	for key, value := range merged {
+		err := sip2.SetField(req, key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// splitArgs splits a line on spaces, double quotes group words (name="Alice Reader").
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuotes, started := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes, started = !inQuotes, true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated quote")
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
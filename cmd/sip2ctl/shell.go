@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sip2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxHistory = 1000
+
+// secretField reports whether a field is masked in the history file: the passwords (CO, AC,
+// AD), as in the audit log, and the login user id (CN).
+func secretField(name string) bool {
+	return strings.Contains(name, "password") || name == "login_user_id" || name == "login_user"
+}
+
+type shell struct {
+	pool        *sip2.ClientPool
+	out         io.Writer
+	defaults    map[string]string
+	history     []string
+	historyFile *os.File
+}
+
+func newShell(pool *sip2.ClientPool, out io.Writer) *shell {
+	return &shell{pool: pool, out: out, defaults: make(map[string]string)}
+}
+
+// frameWriter prints the frames of the JSONL transcript written by a sip2.Recorder.
+type frameWriter struct {
+	w io.Writer
+}
+
+func (fw *frameWriter) Write(b []byte) (int, error) {
+	var record sip2.Record
+	err := json.Unmarshal(b, &record)
+	if err != nil {
+		return 0, err
+	}
+	arrow := "<-"
+	if record.Direction == sip2.DirectionRequest {
+		arrow = "->"
+	}
+	fmt.Fprintf(fw.w, "%s %s\n", arrow, strings.TrimRight(record.Frame, "\r\n"))
+	return len(b), nil
+}
+
+// login logs the connection of the pool in, the pool logs in again the connections it
+// replaces.
+func (s *shell) login(user, password, location string) error {
+	err := s.pool.Login(user, password, location)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "logged in as %s\n", user)
+	return nil
+}
+
+// exec runs one line, built-in commands included.
+func (s *shell) exec(line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	switch args[0] {
+	case "help":
+		s.help(args[1:])
+		return nil
+	case "history":
+		for i, h := range s.history {
+			fmt.Fprintf(s.out, "%4d  %s\n", i+1, h)
+		}
+		return nil
+	case "set":
+		for _, arg := range args[1:] {
+			i := strings.IndexByte(arg, '=')
+			if i < 0 {
+				return fmt.Errorf("set: %s is not a field=value pair", arg)
+			}
+			s.defaults[arg[:i]] = arg[i+1:]
+		}
+		return nil
+	}
+	method, err := resolveMethod(args[0])
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	for _, arg := range args[1:] {
+		i := strings.IndexByte(arg, '=')
+		if i < 0 {
+			return fmt.Errorf("%s is not a field=value pair", arg)
+		}
+		values[arg[:i]] = arg[i+1:]
+	}
+	if method == "login" {
+		req, err := buildRequest(method, values, s.defaults)
+		if err != nil {
+			return err
+		}
+		login := req.(*sip2.LoginRequest)
+		return s.login(string(*login.LoginUserID.StrValue), string(*login.LoginPassword.StrValue), string(*login.LocationCode.StrValue))
+	}
+	_, err = s.send(method, values)
+	return err
+}
+
+func (s *shell) send(method string, values map[string]string) (interface{}, error) {
+	req, err := buildRequest(method, values, s.defaults)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.pool.ReliableCommunicate(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(s.out, "%s\n", b)
+	return resp, nil
+}
+
+func (s *shell) help(args []string) {
+	if len(args) == 0 {
+		methods := make([]string, 0, len(sip2.MethodMap))
+		for method := range sip2.MethodMap {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		fmt.Fprintf(s.out, "methods: %s\n", strings.Join(methods, " "))
+		fmt.Fprintln(s.out, "usage: <method> field=value ..., help <method>, set field=value ..., history, !N, !!, quit")
+		return
+	}
+	method, err := resolveMethod(args[0])
+	if err != nil {
+		fmt.Fprintln(s.out, err)
+		return
+	}
+	fmt.Fprintf(s.out, "%s fields: %s\n", method, strings.Join(requestFields(method), " "))
+}
+
+// runScript stops at the first failure unless keepGoing is set.
+func (s *shell) runScript(r io.Reader, keepGoing bool) error {
+	scanner := bufio.NewScanner(r)
+	var failed error
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fmt.Fprintf(s.out, "> %s\n", line)
+		err := s.exec(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", n, err)
+			if !keepGoing {
+				return err
+			}
+			failed = err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return failed
+}
+
+func (s *shell) runInteractive(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprint(s.out, "sip2> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "quit" || line == "exit" {
+			return
+		}
+		if strings.HasPrefix(line, "!") {
+			expanded, err := s.expand(line)
+			if err != nil {
+				fmt.Fprintln(s.out, err)
+				continue
+			}
+			line = expanded
+			fmt.Fprintln(s.out, line)
+		}
+		s.addHistory(line)
+		err := s.exec(line)
+		if err != nil {
+			fmt.Fprintf(s.out, "error: %s\n", err)
+		}
+	}
+}
+
+// expand replaces !! with the last line and !N with the N-th line of the history.
+func (s *shell) expand(line string) (string, error) {
+	if len(s.history) == 0 {
+		return "", errors.New("history is empty")
+	}
+	if line == "!!" {
+		return s.history[len(s.history)-1], nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(s.history) {
+		return "", fmt.Errorf("%s: no such history entry", line)
+	}
+	return s.history[n-1], nil
+}
+
+func (s *shell) loadHistory(path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			s.history = append(s.history, line)
+		}
+	}
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+	s.historyFile = f
+}
+
+func (s *shell) addHistory(line string) {
+	if len(s.history) > 0 && s.history[len(s.history)-1] == line {
+		return
+	}
+	s.history = append(s.history, line)
+	if s.historyFile != nil {
+		fmt.Fprintln(s.historyFile, maskSecrets(line))
+	}
+}
+
+// maskSecrets replaces the values of the secret fields of a line by ***.
+func maskSecrets(line string) string {
+	args, err := splitArgs(line)
+	quoted := err == nil
+	if !quoted {
+		// an unterminated quote, a secret may run to the end of the line
+		args = strings.Fields(line)
+	}
+	masked := false
+	for i, arg := range args {
+		j := strings.IndexByte(arg, '=')
+		if j < 0 {
+			continue
+		}
+		if key := arg[:j]; secretField(key) {
+			args[i], masked = key+"=***", true
+			if !quoted {
+				args = args[:i+1]
+				break
+			}
+		} else if strings.ContainsAny(arg, " \t") {
+			args[i] = arg[:j+1] + `"` + arg[j+1:] + `"`
+		}
+	}
+	if !masked {
+		return line
+	}
+	return strings.Join(args, " ")
+}
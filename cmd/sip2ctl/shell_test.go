@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`checkout  patron_id=P001 	screen_message="checked out" x=`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"checkout", "patron_id=P001", "screen_message=checked out", "x="}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("got %q, want %q", args, want)
+	}
+	if _, err = splitArgs(`checkout name="Alice`); err == nil {
+		t.Fatal("expected an unterminated quote error")
+	}
+}
+
+func TestMaskSecrets(t *testing.T) {
+	for _, c := range []struct{ line, want string }{
+		{"checkout patron_id=P001 item_id=I001", "checkout patron_id=P001 item_id=I001"},
+		{"checkout patron_id=P001 patron_password=1234", "checkout patron_id=P001 patron_password=***"},
+		{"login login_user_id=kiosk login_password=secret location_code=hall", "login login_user_id=*** login_password=*** location_code=hall"},
+		{`set terminal_password=tp screen_message="a b"`, `set terminal_password=*** screen_message="a b"`},
+		{`checkout patron_password="1 2 item_id=I001`, `checkout patron_password=***`},
+	} {
+		if got := maskSecrets(c.line); got != c.want {
+			t.Errorf("maskSecrets(%q) = %q, want %q", c.line, got, c.want)
+		}
+	}
+}
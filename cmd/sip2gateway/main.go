@@ -0,0 +1,97 @@
+// Command sip2gateway serves the JSON API of SIPServer.
+//
+//	sip2gateway -config /etc/sip2/config.json
+//
+// The config path can be given by the SIP2_GATEWAY_CONFIG environment variable too. On SIGINT
+// or SIGTERM the gateway stops accepting requests and drains the in-flight ones within the
+// shutdown timeout, a second signal exits at once. Exit status: 0 after a clean shutdown,
+// 1 when the gateway cannot start or stops on a serving error, 2 on bad usage, 3 when the
+// drain fails or times out.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sip2"
+	"syscall"
+	"time"
+)
+
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitShutdown
+)
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	defaultConfig := os.Getenv("SIP2_GATEWAY_CONFIG")
+	if defaultConfig == "" {
+		defaultConfig = "config.json"
+	}
+	flags := flag.NewFlagSet("sip2gateway", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfig, "config file, defaults to $SIP2_GATEWAY_CONFIG")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 30*time.Second, "time given to in-flight requests on shutdown")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "sip2gateway: unexpected arguments %v\n", flags.Args())
+		return exitUsage
+	}
+
+	logger := log.New(os.Stderr, "sip2gateway: ", log.LstdFlags)
+	server, err := sip2.NewSIPServer(*configPath, nil, nil)
+	if err != nil {
+		logger.Printf("cannot start with %s: %s", *configPath, err)
+		return exitFailure
+	}
+	logger.Printf("connected to the ACS, listening on %s", server.Addr())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err = <-serveErr:
+		logger.Printf("serving failed: %s", err)
+		shutdown(server, *shutdownTimeout)
+		return exitFailure
+	case sig := <-signals:
+		logger.Printf("%s received, draining in-flight requests", sig)
+	}
+	go func() {
+		sig := <-signals
+		logger.Printf("%s received again, exiting", sig)
+		os.Exit(exitShutdown)
+	}()
+	err = shutdown(server, *shutdownTimeout)
+	if err != nil {
+		logger.Printf("shutdown failed: %s", err)
+		return exitShutdown
+	}
+	if err = <-serveErr; err != nil && err != http.ErrServerClosed {
+		logger.Printf("serving failed: %s", err)
+		return exitFailure
+	}
+	logger.Print("stopped")
+	return exitOK
+}
+
+func shutdown(server *sip2.SIPServer, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
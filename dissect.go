@@ -0,0 +1,194 @@
+package sip2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	ChecksumOK      = "ok"
+	ChecksumBad     = "bad"
+	ChecksumMissing = "missing"
+)
+
+// Dissection is the decoded form of one raw frame, as produced by Dissect.
+type Dissection struct {
+	CommandID     string           `json:"command_id"`
+	Type          string           `json:"type,omitempty"`
+	Sequence      int              `json:"sequence"`
+	Checksum      string           `json:"checksum"`
+	UnknownFields []string         `json:"unknown_fields,omitempty"`
+	Fields        []DissectedField `json:"fields,omitempty"`
+	Message       interface{}      `json:"message,omitempty"`
+	Error         string           `json:"error,omitempty"`
+}
+
+// Dissect decodes a raw request or response frame. Unlike DecodeRequest and DecodeResponse
+// it never fails: a bad checksum, unknown field ids and decoding errors are reported in the
+// Dissection.
+func Dissect(frame []byte) *Dissection {
+	d := &Dissection{Checksum: ChecksumMissing, Sequence: -1}
+	trimmed := bytes.Trim(frame, "\r\n")
+	if l := len(trimmed); l >= 6 && string(trimmed[l-6:l-4]) == "AZ" {
+		d.Checksum = ChecksumOK
+		if checkSum(append(trimmed[:l:l], '\r')) != nil {
+			d.Checksum = ChecksumBad
+		}
+	}
+	body, seq, _ := ParseFrame(frame, false)
+	d.Sequence = seq
+	if len(body) < 2 {
+		d.Error = "Dissect: message too short"
+		return d
+	}
+	d.CommandID = string(body[:2])
+	msg, err := GenRequest(d.CommandID)
+	reader := bytes.NewReader(body)
+	if err != nil {
+		msg, err = GenResponse(d.CommandID)
+		if err != nil {
+			d.Error = "Dissect: unknown command id " + d.CommandID
+			return d
+		}
+		reader = bytes.NewReader(body[2:])
+	}
+	d.Type = reflect.TypeOf(msg).Elem().Name()
+	d.UnknownFields = unknownFields(body, msg)
+	d.Fields = dissectFields(trimmed, body, msg)
+	err = decodeFields(reader, msg)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Message = msg
+	return d
+}
+
+func unknownFields(body []byte, msg interface{}) []string {
+	fixed := fixedLength(string(body[:2]))
+	if fixed < 0 || fixed > len(body) {
+		return nil
+	}
+	_, variable := classifyFields(msg)
+	var unknown []string
+	for _, piece := range bytes.Split(body[fixed:], []byte("|")) {
+		if len(piece) < 2 {
+			continue
+		}
+		if _, ok := variable[string(piece[:2])]; !ok {
+			unknown = append(unknown, string(piece[:2]))
+		}
+	}
+	return unknown
+}
+
+// DissectedField is one field of a frame, Start and End are its byte offsets in the frame
+// once the leading line feeds are trimmed (End excluded).
+type DissectedField struct {
+	ID    string      `json:"id,omitempty"`
+	Name  string      `json:"name"`
+	Start int         `json:"start"`
+	End   int         `json:"end"`
+	Raw   string      `json:"raw"`
+	Value interface{} `json:"value,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+func dissectFields(frame, body []byte, msg interface{}) []DissectedField {
+	fields := make([]DissectedField, 0, 16)
+	fixed, variable := classifyFields(msg)
+	offset := 0
+	if _, ok := ResponseMap[string(body[:2])]; ok {
+		fields = append(fields, DissectedField{Name: "command_id", End: 2, Raw: string(body[:2]), Value: string(body[:2])})
+		offset = 2
+	}
+	for _, field := range fixed {
+		_, name, length := field.Info()
+		if offset+length > len(body) {
+			fields = append(fields, DissectedField{Name: name, Start: offset, End: len(body), Raw: string(body[offset:]), Error: "truncated field"})
+			return fields
+		}
+		fields = append(fields, dissectField(field, name, body[offset:offset+length], offset))
+		offset += length
+	}
+	for offset < len(body) {
+		end := bytes.IndexByte(body[offset:], '|')
+		if end < 0 {
+			end = len(body)
+		} else {
+			end += offset
+		}
+		piece := body[offset:end]
+		if len(piece) >= 2 {
+			if field, ok := variable[string(piece[:2])]; ok {
+				_, name, _ := field.Info()
+				fields = append(fields, dissectField(field, name, piece, offset))
+			} else {
+				fields = append(fields, DissectedField{ID: string(piece[:2]), Name: "unknown", Start: offset, End: end, Raw: string(piece), Value: string(piece[2:])})
+			}
+		}
+		offset = end + 1
+	}
+	trailer := frame[len(body):]
+	offset = len(body)
+	if len(trailer) >= 3 && string(trailer[:2]) == "AY" {
+		fields = append(fields, DissectedField{ID: "AY", Name: "sequence_number", Start: offset, End: offset + 3, Raw: string(trailer[:3]), Value: int(trailer[2] - '0')})
+		trailer, offset = trailer[3:], offset+3
+	}
+	if len(trailer) >= 6 && string(trailer[:2]) == "AZ" {
+		field := DissectedField{ID: "AZ", Name: "checksum", Start: offset, End: offset + 6, Raw: string(trailer[:6]), Value: string(trailer[2:6])}
+		if checkSum(append(frame[:offset+6:offset+6], '\r')) != nil {
+			field.Error = "checksum mismatch, expected " + strings.TrimSuffix(genChecksum(frame[:offset+2]), "\r")
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// dissectField decodes a single field into a fresh copy of the given one.
+func dissectField(field SipField, name string, raw []byte, offset int) DissectedField {
+	id, _, length := field.Info()
+	df := DissectedField{ID: id, Name: name, Start: offset, End: offset + len(raw), Raw: string(raw)}
+	val := reflect.New(reflect.TypeOf(field)).Elem()
+	val.Field(0).Set(reflect.New(val.Field(0).Type().Elem()))
+	fresh := val.Interface().(SipField)
+	if id != "" {
+		raw = append(raw[:len(raw):len(raw)], '|')
+	}
+	err := fresh.Decode(bytes.NewReader(raw), id, length)
+	if err != nil {
+		df.Error = err.Error()
+		return df
+	}
+	df.Value = val.Field(0).Interface()
+	return df
+}
+
+// FormatFrame returns an annotated breakdown of a raw frame, one line per field with its
+// byte range, id, name and decoded value.
+func FormatFrame(frame []byte) string {
+	d := Dissect(frame)
+	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	fmt.Fprintf(buffer, "%s %s seq=%d checksum=%s\n", d.CommandID, d.Type, d.Sequence, d.Checksum)
+	for _, field := range d.Fields {
+		value := field.Raw
+		if field.Value != nil {
+			b, err := json.Marshal(field.Value)
+			if err == nil {
+				value = string(b)
+			}
+		}
+		fmt.Fprintf(buffer, "  [%3d:%3d] %-2s %-28s %s", field.Start, field.End, field.ID, field.Name, value)
+		if field.Error != "" {
+			fmt.Fprintf(buffer, "  ! %s", field.Error)
+		}
+		buffer.WriteString("\n")
+	}
+	if d.Error != "" {
+		fmt.Fprintf(buffer, "  ! %s\n", d.Error)
+	}
+	return buffer.String()
+}
@@ -0,0 +1,58 @@
+package sip2_test
+
+import (
+	"sip2"
+	"strings"
+	"testing"
+)
+
+func TestDissectFields(t *testing.T) {
+	frame := sip2.BuildFrame([]byte("2300120180416    150701AO0001|AA0001|AC|ADsecret|"), 2)
+	d := sip2.Dissect(frame)
+	if d.Error != "" || d.Checksum != sip2.ChecksumOK {
+		t.Fatalf("unexpected dissection: %+v", d)
+	}
+	want := []struct {
+		id, name   string
+		start, end int
+	}{
+		{"", "command_id", 0, 2},
+		{"", "language_id", 2, 5},
+		{"", "transaction_date", 5, 23},
+		{"AO", "institution_id", 23, 29},
+		{"AA", "patron_id", 30, 36},
+		{"AC", "terminal_password", 37, 39},
+		{"AD", "patron_password", 40, 48},
+		{"AY", "sequence_number", 49, 52},
+		{"AZ", "checksum", 52, 58},
+	}
+	if len(d.Fields) != len(want) {
+		t.Fatalf("want %d fields, got %+v", len(want), d.Fields)
+	}
+	for i, w := range want {
+		f := d.Fields[i]
+		if f.ID != w.id || f.Name != w.name || f.Start != w.start || f.End != w.end {
+			t.Errorf("field %d: want %v, got %+v", i, w, f)
+		}
+		if f.Error != "" {
+			t.Errorf("field %s: %s", f.Name, f.Error)
+		}
+	}
+	out := sip2.FormatFrame(frame)
+	if !strings.Contains(out, `[ 30: 36] AA patron_id`) || !strings.Contains(out, `"2018-04-16 15:07:01"`) {
+		t.Errorf("unexpected breakdown:\n%s", out)
+	}
+}
+
+func TestDissectFieldsBadChecksum(t *testing.T) {
+	frame := sip2.BuildFrame([]byte("24              00120231019    120000AOlib|AAP001|BLY|"), 1)
+	frame[len(frame)-2] ^= 1
+	d := sip2.Dissect(frame)
+	last := d.Fields[len(d.Fields)-1]
+	if last.Name != "checksum" || !strings.HasPrefix(last.Error, "checksum mismatch") {
+		t.Errorf("want checksum mismatch, got %+v", last)
+	}
+	if d.Fields[0].Name != "command_id" || d.Fields[1].Name != "patron_status" {
+		t.Errorf("unexpected fixed fields: %+v", d.Fields[:2])
+	}
+}
@@ -0,0 +1,124 @@
+package sip2
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// SIPError is a class of failure, with the HTTP status and the stable code the JSON API
+// reports it with. The errors returned by ClientPool and written by SIPServer wrap one of
+// the Err values below, test them with errors.Is.
+type SIPError struct {
+	Code   string
+	Status int
+	Msg    string
+}
+
+func (e *SIPError) Error() string {
+	return e.Msg
+}
+
+var (
+	ErrValidation     = &SIPError{Code: "validation_error", Status: http.StatusBadRequest, Msg: "invalid request"}
+	ErrUnknownMethod  = &SIPError{Code: "unknown_method", Status: http.StatusNotFound, Msg: "unknown method"}
+	ErrACSUnavailable = &SIPError{Code: "acs_unavailable", Status: http.StatusServiceUnavailable, Msg: "ACS unavailable"}
+	ErrTimeout        = &SIPError{Code: "acs_timeout", Status: http.StatusGatewayTimeout, Msg: "ACS timeout"}
+	ErrProtocol       = &SIPError{Code: "protocol_error", Status: http.StatusBadGateway, Msg: "SIP protocol error"}
+	ErrRejected       = &SIPError{Code: "rejected", Status: http.StatusUnprocessableEntity, Msg: "transaction rejected by the ACS"}
+	// the REST routes report these too
+	ErrNotFound         = &SIPError{Code: "not_found", Status: http.StatusNotFound, Msg: "not found"}
+	ErrForbidden        = &SIPError{Code: "forbidden", Status: http.StatusForbidden, Msg: "forbidden"}
+	ErrMethodNotAllowed = &SIPError{Code: "method_not_allowed", Status: http.StatusMethodNotAllowed, Msg: "method not allowed"}
+	// a client matching no profile or not authenticated, see WithProfiles and WithAuthenticator
+	ErrUnauthorized = &SIPError{Code: "unauthorized", Status: http.StatusUnauthorized, Msg: "unauthorized"}
+	// a request over a rate limit, see WithRateLimits
+	ErrRateLimited = &SIPError{Code: "rate_limited", Status: http.StatusTooManyRequests, Msg: "rate limit exceeded"}
+	// an idempotency key reused with another request, see WithIdempotency
+	ErrConflict = &SIPError{Code: "idempotency_conflict", Status: http.StatusConflict, Msg: "idempotency conflict"}
+	// a request body over 1MB
+	ErrTooLarge = &SIPError{Code: "request_too_large", Status: http.StatusRequestEntityTooLarge, Msg: "request body too large"}
+)
+
+type classifiedError struct {
+	kind *SIPError
+	msg  string
+	// response is the ACS response of a rejected transaction
+	response interface{}
+}
+
+func (e *classifiedError) Error() string {
+	return e.msg
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.kind
+}
+
+func newError(kind *SIPError, msg string) error {
+	return &classifiedError{kind: kind, msg: msg}
+}
+
+// newRejectedError keeps the response of the ACS, WriteError sends it as the item.
+func newRejectedError(msg string, response interface{}) error {
+	return &classifiedError{kind: ErrRejected, msg: msg, response: response}
+}
+
+// ErrorStatus returns the HTTP status and the code of an error, 500 and internal_error when
+// it wraps no SIPError.
+func ErrorStatus(err error) (int, string) {
+	var sipErr *SIPError
+	if errors.As(err, &sipErr) {
+		return sipErr.Status, sipErr.Code
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// classifyError wraps the errors of an exchange in the SIPError they belong to. A dial
+// timeout is ErrACSUnavailable: unlike a timeout after the write, the request did not reach
+// the ACS.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var sipErr *SIPError
+	if errors.As(err, &sipErr) {
+		return err
+	}
+	if err == errCorrupted {
+		return newError(ErrProtocol, err.Error())
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return newError(ErrACSUnavailable, "ReliableCommunicate: "+err.Error())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return newError(ErrTimeout, "ReliableCommunicate: "+err.Error())
+	}
+	return newError(ErrACSUnavailable, "ReliableCommunicate: "+err.Error())
+}
+
+// WriteError is the default error handler of SIPServer: the JSON envelope with the HTTP
+// status of the error as code and its SIPError code as error_code. The item is the ACS
+// response of a rejected transaction or the invalid fields of a ValidationError.
+func WriteError(w http.ResponseWriter, err error) {
+	status, code := ErrorStatus(err)
+	resp := NewJSONResponse("2.0", err.Error(), status)
+	resp.Data.ErrorCode = code
+	resp.Data.Item = errorItem(err)
+	writeJSON(w, status, resp)
+}
+
+// errorItem is the ACS response of a rejected transaction or the invalid fields of a
+// ValidationError, nil for the other errors.
+func errorItem(err error) interface{} {
+	var classified *classifiedError
+	var invalid *ValidationError
+	if errors.As(err, &classified) {
+		return classified.response
+	} else if errors.As(err, &invalid) {
+		return invalid.Fields
+	}
+	return nil
+}
@@ -28,6 +28,9 @@ func (sv *StrValue) Encode(id string, length int) []byte {
 		template := fmt.Sprintf("%%%dv", length)
 		copy(b, fmt.Sprintf(template, *sv))
 		buffer.Write(b)
+		if id != "" {
+			buffer.WriteString("|")
+		}
 	}
 	return buffer.Bytes()
 }
@@ -68,9 +71,12 @@ func (bv *BoolValue) Encode(id string, length int) []byte {
 	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
 	buffer.WriteString(id)
 	if *bv {
-		buffer.WriteString("Y|")
+		buffer.WriteString("Y")
 	} else {
-		buffer.WriteString("N|")
+		buffer.WriteString("N")
+	}
+	if id != "" {
+		buffer.WriteString("|")
 	}
 	return buffer.Bytes()
 }
@@ -129,6 +135,9 @@ func (iv *IntValue) Encode(id string, length int) []byte {
 		template := fmt.Sprintf("%%0%dd", length)
 		copy(b, []byte(fmt.Sprintf(template, *iv)))
 		buffer.Write(b)
+		if id != "" {
+			buffer.WriteString("|")
+		}
 	}
 	return buffer.Bytes()
 }
@@ -216,6 +225,9 @@ func (tv *TimeValue) Encode(id string, length int) []byte {
 	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
 	buffer.WriteString(id)
 	buffer.WriteString(time.Time(*tv).Format("20060102    150405"))
+	if id != "" {
+		buffer.WriteString("|")
+	}
 	return buffer.Bytes()
 }
 
@@ -249,7 +261,16 @@ func (tv *TimeValue) MarshalJSON() ([]byte, error) {
 }
 
 func (tv *TimeValue) UnmarshalJSON(b []byte) error {
-	t, err := time.Parse("2006-01-02 15:04:05", string(b))
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	if s == "" {
+		*tv = TimeValue(time.Time{})
+		return nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", s)
 	if err != nil {
 		return err
 	}
@@ -288,7 +309,7 @@ func (ssv *StrSliceValue) MarshalJSON() ([]byte, error) {
 
 func (ssv *StrSliceValue) UnmarshalJSON(b []byte) error {
 	ss := make([]string, 0, 16)
-	err := json.Unmarshal(b, ss)
+	err := json.Unmarshal(b, &ss)
 	if err != nil {
 		return err
 	}
@@ -360,6 +381,14 @@ func (ft FeeType) Info() (id, name string, length int) {
 	return "", "fee type", 2
 }
 
+type ItemFeeType struct {
+	*IntValue
+}
+
+func (ift ItemFeeType) Info() (id, name string, length int) {
+	return "BT", "item_fee_type", 2
+}
+
 type PaymentType struct {
 	*IntValue
 }
@@ -592,6 +621,15 @@ func (pl PickupLocation) Info() (id, name string, length int) {
 	return "BS", "pickup_location", -1
 }
 
+// HoldMode is + to add, - to delete and * to change a hold.
+type HoldMode struct {
+	*StrValue
+}
+
+func (hm HoldMode) Info() (id, name string, length int) {
+	return "", "hold_mode", 1
+}
+
 type HoldType struct {
 	*IntValue
 }
@@ -600,6 +638,14 @@ func (ht HoldType) Info() (id, name string, length int) {
 	return "BY", "hold_type", 1
 }
 
+// Encode leaves BY out when the hold type is unset (0), it is optional.
+func (ht HoldType) Encode(id string, length int) []byte {
+	if ht.IntValue == nil || *ht.IntValue == 0 {
+		return nil
+	}
+	return ht.IntValue.Encode(id, length)
+}
+
 type TitleID struct {
 	*StrValue
 }
@@ -0,0 +1,336 @@
+package sip2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header naming a mutating request, its repeats get
+// the response of the first one.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// StoredResponse is a response kept for the repeats of a request. Fingerprint identifies
+// the request, a repeat with another method, path or body is refused.
+type StoredResponse struct {
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	Fingerprint string      `json:"fingerprint"`
+	Expires     time.Time   `json:"expires"`
+}
+
+// IdempotencyStore keeps the responses of the requests with an idempotency key until
+// they expire. Get returns nil for an unknown or expired key.
+type IdempotencyStore interface {
+	Get(key string) (*StoredResponse, error)
+	Put(key string, resp *StoredResponse) error
+}
+
+// DefaultIdempotencyWindow is the window of WithIdempotency when it is not positive.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// WithIdempotency makes the mutating requests with an Idempotency-Key header answered once:
+// the response is kept in store for window, the repeats get it back and the repeats arriving
+// while the first request runs wait for it. Only the 2xx and 4xx responses are kept, those of
+// a rate limited request excepted, so that a request failing on a transient error is retried.
+func WithIdempotency(store IdempotencyStore, window time.Duration) Option {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	return func(ss *SIPServer) {
+		ss.idempotency = &idempotency{store: store, window: window, running: make(map[string]chan struct{})}
+	}
+}
+
+type idempotency struct {
+	store   IdempotencyStore
+	window  time.Duration
+	mu      sync.Mutex
+	running map[string]chan struct{}
+	// logger is set by NewHandler
+	logger Logger
+}
+
+// middleware serves the repeats from the store, next serves the first request.
+func (id *idempotency) middleware(errHandler func(http.ResponseWriter, error), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			errHandler(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if readOnlyRequest(r, body) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cred, ok := CredentialFromContext(r.Context()); ok {
+			key = cred.Name + "|" + key
+		}
+		sum := sha256.Sum256([]byte(r.Method + "\n" + r.URL.Path + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+		for {
+			stored, err := id.store.Get(key)
+			if err != nil {
+				errHandler(w, err)
+				return
+			}
+			if stored != nil {
+				if stored.Fingerprint != fingerprint {
+					errHandler(w, newError(ErrConflict, "idempotency key reused with another request"))
+					return
+				}
+				stored.write(w)
+				return
+			}
+			id.mu.Lock()
+			done, ok := id.running[key]
+			if !ok {
+				done = make(chan struct{})
+				id.running[key] = done
+			}
+			id.mu.Unlock()
+			if !ok {
+				break
+			}
+			select {
+			case <-done:
+			case <-r.Context().Done():
+				errHandler(w, newError(ErrConflict, "request with the same idempotency key in progress"))
+				return
+			}
+		}
+		defer func() {
+			id.mu.Lock()
+			close(id.running[key])
+			delete(id.running, key)
+			id.mu.Unlock()
+		}()
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if !cacheable(rec.status) {
+			return
+		}
+		err = id.store.Put(key, &StoredResponse{
+			Status:      rec.status,
+			Header:      w.Header().Clone(),
+			Body:        rec.body.Bytes(),
+			Fingerprint: fingerprint,
+			Expires:     time.Now().Add(id.window),
+		})
+		if err != nil {
+			id.logger.Log(LevelError, "idempotency store failed", F("error", err))
+		}
+	})
+}
+
+// cacheable is true for the statuses of the final answers to a request.
+func cacheable(status int) bool {
+	return status >= 200 && status < 300 || status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+// readOnlyRequest is true for the JSON API requests of a read-only method.
+func readOnlyRequest(r *http.Request, body []byte) bool {
+	var envelope struct {
+		Header struct {
+			Method string `json:"method"`
+		} `json:"header"`
+	}
+	json.Unmarshal(body, &envelope)
+	return readOnlyMethods[envelope.Header.Method]
+}
+
+func (sr *StoredResponse) write(w http.ResponseWriter) {
+	for name, values := range sr.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(sr.Status)
+	w.Write(sr.Body)
+}
+
+// recordingWriter keeps a copy of the response it writes.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// MemoryIdempotencyStore keeps the responses in memory.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*StoredResponse
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{responses: make(map[string]*StoredResponse)}
+}
+
+func (ms *MemoryIdempotencyStore) Get(key string) (*StoredResponse, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	resp, ok := ms.responses[key]
+	if !ok || time.Now().After(resp.Expires) {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func (ms *MemoryIdempotencyStore) Put(key string, resp *StoredResponse) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	for k, r := range ms.responses {
+		if now.After(r.Expires) {
+			delete(ms.responses, k)
+		}
+	}
+	ms.responses[key] = resp
+	return nil
+}
+
+// FileIdempotencyStore is a MemoryIdempotencyStore appending every response to a JSONL file,
+// the responses not expired yet are loaded back by NewFileIdempotencyStore. The file holds
+// the responses in full, headers and bodies with the patron data they carry, and is created
+// readable by its owner only. It is rewritten with the live responses at start and whenever
+// the expired ones make up most of it.
+type FileIdempotencyStore struct {
+	*MemoryIdempotencyStore
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	// lines is the number of responses in the file
+	lines int
+}
+
+type storedEntry struct {
+	Key      string          `json:"key"`
+	Response *StoredResponse `json:"response"`
+}
+
+// NewFileIdempotencyStore loads path and rewrites it with the live responses only.
+func NewFileIdempotencyStore(path string) (*FileIdempotencyStore, error) {
+	ms := NewMemoryIdempotencyStore()
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4<<20)
+		now := time.Now()
+		for scanner.Scan() {
+			var entry storedEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Response == nil {
+				continue
+			}
+			if now.Before(entry.Response.Expires) {
+				ms.responses[entry.Key] = entry.Response
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	fs := &FileIdempotencyStore{MemoryIdempotencyStore: ms, path: path}
+	if err = fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// compact rewrites the file with the live responses, fs.mu held.
+func (fs *FileIdempotencyStore) compact() error {
+	fs.MemoryIdempotencyStore.mu.Lock()
+	now := time.Now()
+	entries := make([]storedEntry, 0, len(fs.responses))
+	for key, resp := range fs.responses {
+		if now.After(resp.Expires) {
+			delete(fs.responses, key)
+			continue
+		}
+		entries = append(entries, storedEntry{Key: key, Response: resp})
+	}
+	fs.MemoryIdempotencyStore.mu.Unlock()
+	tmp := fs.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		b, _ := json.Marshal(entry)
+		out.Write(append(b, '\n'))
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fs.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if fs.f != nil {
+		fs.f.Close()
+	}
+	fs.f, fs.lines = f, len(entries)
+	return nil
+}
+
+func (fs *FileIdempotencyStore) Put(key string, resp *StoredResponse) error {
+	b, err := json.Marshal(storedEntry{Key: key, Response: resp})
+	if err != nil {
+		return err
+	}
+	if err = fs.MemoryIdempotencyStore.Put(key, resp); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, err = fs.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	fs.lines++
+	if fs.lines > 100 && fs.lines > 2*fs.live() {
+		return fs.compact()
+	}
+	return nil
+}
+
+// live is the number of responses kept in memory.
+func (fs *FileIdempotencyStore) live() int {
+	fs.MemoryIdempotencyStore.mu.Lock()
+	defer fs.MemoryIdempotencyStore.mu.Unlock()
+	return len(fs.responses)
+}
+
+func (fs *FileIdempotencyStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
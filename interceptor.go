@@ -0,0 +1,72 @@
+package sip2
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// Invoker exchanges a request with the ACS, or with the interceptors after the current one.
+type Invoker func(ctx context.Context, req interface{}) (interface{}, error)
+
+// Interceptor runs around the exchanges of a pool: it may change the request, call next any
+// number of times or not at all and return its own response. The frames of the exchange are
+// in FramesFromContext(ctx) once next returns.
+type Interceptor func(ctx context.Context, req interface{}, next Invoker) (interface{}, error)
+
+// Frames are the raw frames of an exchange in the order they went on the wire, the resends
+// and the corrupted responses included, for every call of next.
+type Frames struct {
+	Sent     [][]byte
+	Received [][]byte
+}
+
+type framesKey struct{}
+
+// FramesFromContext returns the frames of the exchange an interceptor runs around, nil
+// outside of an interceptor.
+func FramesFromContext(ctx context.Context) *Frames {
+	frames, _ := ctx.Value(framesKey{}).(*Frames)
+	return frames
+}
+
+func (f *Frames) add(direction string, frame []byte) {
+	if f == nil {
+		return
+	}
+	if direction == DirectionRequest {
+		f.Sent = append(f.Sent, frame)
+	} else {
+		f.Received = append(f.Received, frame)
+	}
+}
+
+// SetInterceptors makes every exchange of the pool, those of Sequence included, run through
+// interceptors, the first one outermost. It should be called before the pool is in use.
+func (p *ClientPool) SetInterceptors(interceptors ...Interceptor) {
+	p.interceptors = interceptors
+}
+
+// intercept runs invoke behind the interceptors of the pool, in the span of the exchange. The
+// calls of invoke are audited.
+func (p *ClientPool) intercept(ctx context.Context, req interface{}, invoke func(ctx context.Context, req interface{}, frames *Frames) (interface{}, error)) (resp interface{}, err error) {
+	ctx, span := startSpan(p.tracer, ctx, "sip2.exchange")
+	span.SetAttribute("sip2.command", reflect.TypeOf(req).Elem().Name())
+	defer func() {
+		endSpan(span, err)
+	}()
+	frames := &Frames{}
+	next := Invoker(func(ctx context.Context, req interface{}) (interface{}, error) {
+		start := time.Now()
+		resp, err := invoke(ctx, req, frames)
+		p.auditExchange(ctx, start, req, resp, err)
+		return resp, err
+	})
+	for i := len(p.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := p.interceptors[i], next
+		next = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, inner)
+		}
+	}
+	return next(context.WithValue(ctx, framesKey{}, frames), req)
+}
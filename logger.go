@@ -0,0 +1,98 @@
+package sip2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("ParseLevel: unknown level %q", s)
+}
+
+// LogField is a key and a value of a log entry.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+// Logger receives the log entries of a pool and of the gateway, Log is called concurrently.
+type Logger interface {
+	Log(level Level, msg string, fields ...LogField)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...LogField) {}
+
+// TextLogger writes the entries from its level up as lines of key=value pairs.
+type TextLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+func NewTextLogger(w io.Writer, level Level) *TextLogger {
+	return &TextLogger{w: w, level: level}
+}
+
+func (tl *TextLogger) Log(level Level, msg string, fields ...LogField) {
+	if level < tl.level {
+		return
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, 256))
+	fmt.Fprintf(buffer, "time=%s level=%s msg=%s", time.Now().Format(time.RFC3339Nano), level, quoteValue(msg))
+	for _, field := range fields {
+		fmt.Fprintf(buffer, " %s=%s", field.Key, quoteValue(fmt.Sprint(field.Value)))
+	}
+	buffer.WriteByte('\n')
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.w.Write(buffer.Bytes())
+}
+
+func quoteValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// RedactFrame returns a copy of a frame, without its line terminator, with the values of
+// DefaultRedactedFields replaced by ***. The checksum is left as it was. Everything after the
+// command id is replaced in a frame of an unknown command.
+func RedactFrame(frame []byte) []byte {
+	return redactFrame(bytes.Trim(frame, "\r\n"), DefaultRedactedFields)
+}
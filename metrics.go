@@ -0,0 +1,189 @@
+package sip2
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics counts the exchanges of a pool and the requests of the JSON API, it serves them in
+// the Prometheus text format. The SIP commands are labelled by request type.
+type Metrics struct {
+	poolSize         int64
+	inUse            int64
+	waiting          int64
+	retries          uint64
+	reconnects       uint64
+	resends          uint64
+	acsResends       uint64
+	checksumFailures uint64
+	// online is the online status of the last SC Status response, -1 before the first one
+	online int32
+	mu     sync.Mutex
+	// exchanges and requests are keyed by label values
+	exchanges map[[2]string]*histogram
+	requests  map[[2]string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newMetrics(poolSize int) *Metrics {
+	return &Metrics{
+		poolSize:  int64(poolSize),
+		online:    -1,
+		exchanges: make(map[[2]string]*histogram),
+		requests:  make(map[[2]string]*histogram),
+	}
+}
+
+// Metrics returns the metrics of the pool, SIPServer serves them on /metrics.
+func (p *ClientPool) Metrics() *Metrics {
+	return p.metrics
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func observe(m map[[2]string]*histogram, key [2]string, d time.Duration) {
+	h, ok := m[key]
+	if !ok {
+		h = &histogram{}
+		m[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// observeExchange counts an exchange with the ACS by request type and outcome.
+func (m *Metrics) observeExchange(req interface{}, resp interface{}, err error, d time.Duration) {
+	outcome := "ok"
+	if err != nil {
+		_, outcome = ErrorStatus(err)
+	}
+	if status, ok := resp.(*ACSStatusResponse); ok {
+		online := int32(0)
+		if bool(*status.OnlineStatus.BoolValue) {
+			online = 1
+		}
+		atomic.StoreInt32(&(m.online), online)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.exchanges, [2]string{reflect.TypeOf(req).Elem().Name(), outcome}, d)
+}
+
+// observeRequest counts a request of the JSON API by method and HTTP status, the methods
+// not in MethodMap are counted as unknown.
+func (m *Metrics) observeRequest(method string, status int, d time.Duration) {
+	if _, ok := MethodMap[method]; !ok {
+		method = "unknown"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.requests, [2]string{method, strconv.Itoa(status)}, d)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	gauge := func(name, help string, value int64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge("sip2_pool_size", "Connections of the pool.", atomic.LoadInt64(&(m.poolSize)))
+	gauge("sip2_pool_in_use", "Connections taken from the pool.", atomic.LoadInt64(&(m.inUse)))
+	gauge("sip2_pool_waiting", "Exchanges waiting for a connection.", atomic.LoadInt64(&(m.waiting)))
+	counter("sip2_retries_total", "Attempts after the first one of an exchange.", atomic.LoadUint64(&(m.retries)))
+	counter("sip2_reconnects_total", "Connections opened to replace a broken one.", atomic.LoadUint64(&(m.reconnects)))
+	counter("sip2_resends_total", "Requests Resend (97) sent for a corrupted response.", atomic.LoadUint64(&(m.resends)))
+	counter("sip2_acs_resends_total", "Requests resent on a Request SC Resend (96) from the ACS.", atomic.LoadUint64(&(m.acsResends)))
+	counter("sip2_checksum_failures_total", "Responses with a wrong checksum.", atomic.LoadUint64(&(m.checksumFailures)))
+	if online := atomic.LoadInt32(&(m.online)); online >= 0 {
+		gauge("sip2_acs_online", "Online status of the last SC Status response.", int64(online))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeHistograms(cw, "sip2_exchange_duration_seconds", "Exchanges with the ACS by request type and outcome.", [2]string{"command", "outcome"}, m.exchanges)
+	writeHistograms(cw, "sip2_http_request_duration_seconds", "Requests of the JSON API by method and status.", [2]string{"method", "code"}, m.requests)
+	return cw.n, cw.err
+}
+
+func writeHistograms(w io.Writer, name, help string, labels [2]string, hs map[[2]string]*histogram) {
+	if len(hs) == 0 {
+		return
+	}
+	keys := make([][2]string, 0, len(hs))
+	for key := range hs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range keys {
+		h := hs[key]
+		l := fmt.Sprintf("%s=%q,%s=%q", labels[0], key[0], labels[1], key[1])
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, l, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, l, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.count)
+	}
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// statusWriter keeps the status of the response it writes.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,346 @@
+package sip2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// OfflineEntry is a checkout or a checkin accepted while the ACS was unreachable, Request
+// is the JSON of the request as it is replayed, its passwords blanked. Profile is the name
+// of the profile of the client, if any.
+type OfflineEntry struct {
+	Seq      int64           `json:"seq"`
+	Method   string          `json:"method"`
+	Request  json.RawMessage `json:"request"`
+	Profile  string          `json:"profile,omitempty"`
+	Accepted time.Time       `json:"accepted"`
+}
+
+// OfflineConflict is an entry the ACS refused on replay, with its response or the error.
+type OfflineConflict struct {
+	Entry      OfflineEntry `json:"entry"`
+	Message    string       `json:"message"`
+	Response   interface{}  `json:"response"`
+	ReplayedAt time.Time    `json:"replayed_at"`
+}
+
+// OfflineJournal keeps the transactions accepted offline in a JSONL file until they are
+// replayed, the conflicts of the replay are appended to a JSONL report. The passwords are not
+// journaled: the replayed entries get the terminal password of their profile, or
+// TerminalPassword when it sets none.
+type OfflineJournal struct {
+	TerminalPassword string
+	path             string
+	reportPath       string
+	loanPeriod       time.Duration
+	// probeInterval is the period of the replays, set by WithOffline
+	probeInterval time.Duration
+	mu            sync.Mutex
+	entries       []OfflineEntry
+	seq           int64
+	// replayMu serializes the replays
+	replayMu sync.Mutex
+	// logger receives the conflicts, profiles give the terminal passwords, set by NewHandler
+	logger   Logger
+	profiles []Profile
+}
+
+// NewOfflineJournal loads the entries of path not replayed yet, loanPeriod sets the
+// provisional due dates of the checkouts.
+func NewOfflineJournal(path, reportPath string, loanPeriod time.Duration) (*OfflineJournal, error) {
+	j := &OfflineJournal{path: path, reportPath: reportPath, loanPeriod: loanPeriod, logger: nopLogger{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry OfflineEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("NewOfflineJournal: %s: %s", path, err)
+		}
+		j.entries = append(j.entries, entry)
+		if entry.Seq > j.seq {
+			j.seq = entry.Seq
+		}
+	}
+	return j, scanner.Err()
+}
+
+// WithOffline accepts the checkouts and checkins in journal when the ACS is unreachable,
+// and replays them every probeInterval until the ACS takes them.
+func WithOffline(journal *OfflineJournal, probeInterval time.Duration) Option {
+	if probeInterval <= 0 {
+		probeInterval = 30 * time.Second
+	}
+	return func(ss *SIPServer) {
+		journal.probeInterval = probeInterval
+		ss.offline = journal
+	}
+}
+
+// Pending is the number of entries not replayed yet.
+func (j *OfflineJournal) Pending() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.entries)
+}
+
+// send exchanges req with communicate, or journals it: the checkouts and checkins go to the
+// journal when the ACS is unreachable, and while entries are pending to keep their order.
+// The SC status reports offline_ok, and is answered offline when the ACS is unreachable.
+// offline is true for a journaled transaction. A timeout is not journaled: the ACS may have
+// applied the transaction, only the failures to reach it are, a dial timeout included.
+func (j *OfflineJournal) send(ctx context.Context, method string, req interface{}, profile *Profile, communicate Invoker) (resp interface{}, offline bool, err error) {
+	switch method {
+	case "check_out", "check_in":
+		if j.Pending() > 0 {
+			resp, err = j.accept(method, req, profile)
+			return resp, err == nil, err
+		}
+		resp, err = communicate(ctx, req)
+		if err != nil && errors.Is(err, ErrACSUnavailable) && err != errPoolClosed {
+			resp, err = j.accept(method, req, profile)
+			return resp, err == nil, err
+		}
+		return resp, false, err
+	case "query_sc_status":
+		resp, err = communicate(ctx, req)
+		if err != nil && errors.Is(err, ErrACSUnavailable) && err != errPoolClosed {
+			status := NewACSStatusResponse()
+			*status.OnlineStatus.BoolValue = false
+			*status.CheckinOK.BoolValue = true
+			*status.CheckoutOK.BoolValue = true
+			*status.OfflineOK.BoolValue = true
+			*status.DateTimeSync.TimeValue = TimeValue(time.Now())
+			*status.ScreenMessage.StrValue = "ACS offline, circulation recorded locally"
+			return status, true, nil
+		}
+		if status, ok := resp.(*ACSStatusResponse); ok {
+			*status.OfflineOK.BoolValue = true
+		}
+		return resp, false, err
+	}
+	resp, err = communicate(ctx, req)
+	return resp, false, err
+}
+
+// accept journals req, its passwords blanked, and returns its provisional response.
+func (j *OfflineJournal) accept(method string, req interface{}, profile *Profile) (interface{}, error) {
+	now := time.Now()
+	var resp interface{}
+	switch r := req.(type) {
+	case *CheckoutRequest:
+		if time.Time(*r.TransactionDate.TimeValue).IsZero() {
+			*r.TransactionDate.TimeValue = TimeValue(now)
+		}
+		due := time.Time(*r.TransactionDate.TimeValue).Add(j.loanPeriod)
+		*r.NBDueDate.TimeValue = TimeValue(due)
+		checkout := NewCheckoutResponse()
+		*checkout.OK.BoolValue = true
+		*checkout.Desensitize.BoolValue = true
+		*checkout.TransactionDate.TimeValue = TimeValue(now)
+		*checkout.InstitutionID.StrValue = *r.InstitutionID.StrValue
+		*checkout.PatronID.StrValue = *r.PatronID.StrValue
+		*checkout.ItemID.StrValue = *r.ItemID.StrValue
+		*checkout.DueDate.TimeValue = TimeValue(due)
+		*checkout.ScreenMessage.StrValue = "Offline checkout, due date provisional"
+		resp = checkout
+	case *CheckinRequest:
+		if time.Time(*r.TransactionDate.TimeValue).IsZero() {
+			*r.TransactionDate.TimeValue = TimeValue(now)
+		}
+		if time.Time(*r.ReturnDate.TimeValue).IsZero() {
+			*r.ReturnDate.TimeValue = *r.TransactionDate.TimeValue
+		}
+		checkin := NewCheckinResponse()
+		*checkin.OK.BoolValue = true
+		*checkin.Resensitize.BoolValue = true
+		*checkin.TransactionDate.TimeValue = TimeValue(now)
+		*checkin.InstitutionID.StrValue = *r.InstitutionID.StrValue
+		*checkin.ItemID.StrValue = *r.ItemID.StrValue
+		*checkin.ScreenMessage.StrValue = "Offline checkin, recorded locally"
+		resp = checkin
+	default:
+		return nil, fmt.Errorf("*OfflineJournal.accept: %T cannot be accepted offline", req)
+	}
+	val := reflect.ValueOf(req).Elem()
+	for _, name := range []string{"TerminalPassword", "PatronPassword"} {
+		if field := val.FieldByName(name); field.IsValid() {
+			sv := StrValue("")
+			field.Field(0).Set(reflect.ValueOf(&sv))
+		}
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry := OfflineEntry{Seq: j.seq + 1, Method: method, Request: b, Accepted: now}
+	if profile != nil {
+		entry.Profile = profile.Name
+	}
+	line, _ := json.Marshal(entry)
+	err = appendLine(j.path, line)
+	if err != nil {
+		return nil, newError(ErrACSUnavailable, "ACS unreachable and offline journal failed: "+err.Error())
+	}
+	j.seq++
+	j.entries = append(j.entries, entry)
+	return resp, nil
+}
+
+// Replay sends the pending entries in order with NoBlock set, it stops at the first entry
+// the exchange fails for and keeps it. The entries the ACS refuses are reported and dropped.
+func (j *OfflineJournal) Replay(pool *ClientPool) error {
+	j.replayMu.Lock()
+	defer j.replayMu.Unlock()
+	for {
+		j.mu.Lock()
+		if len(j.entries) == 0 {
+			j.mu.Unlock()
+			return nil
+		}
+		entry := j.entries[0]
+		j.mu.Unlock()
+		newRequest, ok := MethodMap[entry.Method]
+		if !ok {
+			return fmt.Errorf("*OfflineJournal.Replay: unknown method %s", entry.Method)
+		}
+		req := newRequest()
+		err := json.Unmarshal(entry.Request, req)
+		if err != nil {
+			return fmt.Errorf("*OfflineJournal.Replay: entry %d: %s", entry.Seq, err)
+		}
+		SetField(req, "no_block", "Y")
+		if password := j.terminalPassword(entry.Profile); password != "" && HasField(req, "terminal_password") {
+			sv := StrValue(password)
+			reflect.ValueOf(req).Elem().FieldByName("TerminalPassword").Field(0).Set(reflect.ValueOf(&sv))
+		}
+		resp, err := pool.ReliableCommunicateContext(withAuditClient(context.Background(), "offline-replay"), req)
+		if err != nil {
+			return err
+		}
+		if err = rejection(resp); err != nil {
+			j.logger.Log(LevelWarn, "offline entry refused on replay", F("seq", entry.Seq), F("method", entry.Method), F("error", err))
+			conflict := OfflineConflict{Entry: entry, Message: err.Error(), Response: errorItem(err), ReplayedAt: time.Now()}
+			line, _ := json.Marshal(conflict)
+			if reportErr := appendLine(j.reportPath, line); reportErr != nil {
+				return reportErr
+			}
+		}
+		if err = j.drop(entry.Seq); err != nil {
+			return err
+		}
+	}
+}
+
+// terminalPassword is the terminal password of the profile named profile, or the one of the
+// journal.
+func (j *OfflineJournal) terminalPassword(profile string) string {
+	for i := range j.profiles {
+		if j.profiles[i].Name == profile && j.profiles[i].TerminalPassword != "" {
+			return j.profiles[i].TerminalPassword
+		}
+	}
+	return j.TerminalPassword
+}
+
+// drop removes the first entry and rewrites the journal.
+func (j *OfflineJournal) drop(seq int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.entries) == 0 || j.entries[0].Seq != seq {
+		return nil
+	}
+	j.entries = j.entries[1:]
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range j.entries {
+		line, _ := json.Marshal(entry)
+		w.Write(append(line, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+func (j *OfflineJournal) replayLoop(ctx context.Context, pool *ClientPool) {
+	ticker := time.NewTicker(j.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if j.Pending() > 0 {
+				if err := j.Replay(pool); err != nil {
+					j.logger.Log(LevelWarn, "offline replay stopped", F("pending", j.Pending()), F("error", err))
+				}
+			}
+		}
+	}
+}
+
+// Conflicts reads the conflict report.
+func (j *OfflineJournal) Conflicts() ([]OfflineConflict, error) {
+	f, err := os.Open(j.reportPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var conflicts []OfflineConflict
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var conflict OfflineConflict
+		if err = json.Unmarshal(scanner.Bytes(), &conflict); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, scanner.Err()
+}
+
+// appendLine appends a line to a file and syncs it.
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,251 @@
+// Package pcap reads pcap and pcapng captures and reassembles the SIP2 conversations they contain.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+const (
+	LinkTypeNull     = 0
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLinuxSLL = 113
+	LinkTypeIPv4     = 228
+	LinkTypeIPv6     = 229
+	LinkTypeSLL2     = 276
+)
+
+type Packet struct {
+	Time     time.Time
+	LinkType uint32
+	Data     []byte
+}
+
+type Reader interface {
+	// Next returns io.EOF when there is no more packet.
+	Next() (*Packet, error)
+}
+
+// NewReader detects the file format (pcap or pcapng) from its magic number.
+func NewReader(r io.Reader) (Reader, error) {
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic) == 0x0a0d0d0a:
+		return newNGReader(r)
+	case binary.LittleEndian.Uint32(magic) == 0xa1b2c3d4, binary.LittleEndian.Uint32(magic) == 0xa1b23c4d:
+		return newPcapReader(r, binary.LittleEndian, binary.LittleEndian.Uint32(magic) == 0xa1b23c4d)
+	case binary.BigEndian.Uint32(magic) == 0xa1b2c3d4, binary.BigEndian.Uint32(magic) == 0xa1b23c4d:
+		return newPcapReader(r, binary.BigEndian, binary.BigEndian.Uint32(magic) == 0xa1b23c4d)
+	default:
+		return nil, fmt.Errorf("pcap.NewReader: unknown magic number %x", magic)
+	}
+}
+
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+}
+
+func newPcapReader(r io.Reader, order binary.ByteOrder, nano bool) (*pcapReader, error) {
+	header := make([]byte, 20)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapReader{r: r, order: order, nano: nano, linkType: order.Uint32(header[16:20]) & 0x0fffffff}, nil
+}
+
+func (pr *pcapReader) Next() (*Packet, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(pr.r, header)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("pcapReader.Next: truncated record header")
+		}
+		return nil, err
+	}
+	sec := pr.order.Uint32(header[0:4])
+	frac := pr.order.Uint32(header[4:8])
+	capLen := pr.order.Uint32(header[8:12])
+	if capLen > 256*1024 {
+		return nil, fmt.Errorf("pcapReader.Next: record too large (%d)", capLen)
+	}
+	data := make([]byte, capLen)
+	_, err = io.ReadFull(pr.r, data)
+	if err != nil {
+		return nil, errors.New("pcapReader.Next: truncated record")
+	}
+	nsec := int64(frac) * 1000
+	if pr.nano {
+		nsec = int64(frac)
+	}
+	return &Packet{Time: time.Unix(int64(sec), nsec), LinkType: pr.linkType, Data: data}, nil
+}
+
+type ngInterface struct {
+	linkType uint32
+	// unit of the timestamps, in nanoseconds
+	tsUnit float64
+}
+
+type ngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []ngInterface
+}
+
+func newNGReader(r io.Reader) (*ngReader, error) {
+	nr := &ngReader{r: r}
+	err := nr.readSectionHeader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return nr, nil
+}
+
+// readSectionHeader reads a section header block whose block type is consumed already,
+// length is its total length when it has been consumed too.
+func (nr *ngReader) readSectionHeader(length []byte) error {
+	head := make([]byte, 8)
+	copy(head, length)
+	_, err := io.ReadFull(nr.r, head[len(length):])
+	if err != nil {
+		return err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(head[4:8]) == 0x1a2b3c4d:
+		nr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head[4:8]) == 0x1a2b3c4d:
+		nr.order = binary.BigEndian
+	default:
+		return errors.New("ngReader: bad byte-order magic")
+	}
+	total := nr.order.Uint32(head[0:4])
+	if total < 28 || total%4 != 0 {
+		return fmt.Errorf("ngReader: bad section header length %d", total)
+	}
+	_, err = io.CopyN(ioutil.Discard, nr.r, int64(total)-12)
+	if err != nil {
+		return err
+	}
+	nr.interfaces = nr.interfaces[:0]
+	return nil
+}
+
+func (nr *ngReader) Next() (*Packet, error) {
+	for {
+		head := make([]byte, 8)
+		_, err := io.ReadFull(nr.r, head)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errors.New("ngReader.Next: truncated block header")
+			}
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(head[0:4]) == 0x0a0d0d0a {
+			err = nr.readSectionHeader(head[4:8])
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		blockType := nr.order.Uint32(head[0:4])
+		total := nr.order.Uint32(head[4:8])
+		if total < 12 || total%4 != 0 || total > 1024*1024 {
+			return nil, fmt.Errorf("ngReader.Next: bad block length %d", total)
+		}
+		body := make([]byte, total-8)
+		_, err = io.ReadFull(nr.r, body)
+		if err != nil {
+			return nil, errors.New("ngReader.Next: truncated block")
+		}
+		body = body[:len(body)-4]
+		switch blockType {
+		case 1:
+			nr.readInterface(body)
+		case 3:
+			packet, err := nr.simplePacket(body)
+			if err != nil {
+				return nil, err
+			}
+			return packet, nil
+		case 6:
+			packet, err := nr.enhancedPacket(body)
+			if err != nil {
+				return nil, err
+			}
+			return packet, nil
+		}
+	}
+}
+
+func (nr *ngReader) readInterface(body []byte) {
+	if len(body) < 8 {
+		return
+	}
+	iface := ngInterface{linkType: uint32(nr.order.Uint16(body[0:2])), tsUnit: 1000}
+	options := body[8:]
+	for len(options) >= 4 {
+		code := nr.order.Uint16(options[0:2])
+		length := int(nr.order.Uint16(options[2:4]))
+		if code == 0 || len(options) < 4+length {
+			break
+		}
+		if code == 9 && length >= 1 {
+			resol := options[4]
+			if resol&0x80 == 0 {
+				iface.tsUnit = 1e9 / math.Pow10(int(resol))
+			} else {
+				iface.tsUnit = 1e9 / math.Pow(2, float64(resol&0x7f))
+			}
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	nr.interfaces = append(nr.interfaces, iface)
+}
+
+func (nr *ngReader) enhancedPacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, errors.New("ngReader: enhanced packet block too short")
+	}
+	ifaceID := nr.order.Uint32(body[0:4])
+	if int(ifaceID) >= len(nr.interfaces) {
+		return nil, fmt.Errorf("ngReader: unknown interface %d", ifaceID)
+	}
+	iface := nr.interfaces[ifaceID]
+	ts := uint64(nr.order.Uint32(body[4:8]))<<32 | uint64(nr.order.Uint32(body[8:12]))
+	capLen := nr.order.Uint32(body[12:16])
+	if int(capLen) > len(body)-20 {
+		return nil, errors.New("ngReader: enhanced packet data truncated")
+	}
+	nsec := float64(ts) * iface.tsUnit
+	return &Packet{
+		Time:     time.Unix(0, 0).Add(time.Duration(nsec)),
+		LinkType: iface.linkType,
+		Data:     body[20 : 20+capLen],
+	}, nil
+}
+
+func (nr *ngReader) simplePacket(body []byte) (*Packet, error) {
+	if len(body) < 4 || len(nr.interfaces) == 0 {
+		return nil, errors.New("ngReader: bad simple packet block")
+	}
+	origLen := nr.order.Uint32(body[0:4])
+	data := body[4:]
+	if int(origLen) < len(data) {
+		data = data[:origLen]
+	}
+	return &Packet{LinkType: nr.interfaces[0].linkType, Data: data}, nil
+}
@@ -0,0 +1,203 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sip2"
+	"sip2/pcap"
+	"testing"
+	"time"
+)
+
+type testSegment struct {
+	fromSC  bool
+	seq     uint32
+	flags   uint8
+	payload string
+}
+
+var (
+	scAddr  = []byte{10, 0, 0, 5}
+	acsAddr = []byte{10, 0, 0, 9}
+)
+
+func ethernetFrame(s testSegment) []byte {
+	src, dst, srcPort, dstPort := scAddr, acsAddr, uint16(51234), uint16(6001)
+	if !s.fromSC {
+		src, dst, srcPort, dstPort = acsAddr, scAddr, 6001, 51234
+	}
+	tcp := make([]byte, 20, 20+len(s.payload))
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], s.seq)
+	tcp[12] = 5 << 4
+	tcp[13] = s.flags
+	tcp = append(tcp, s.payload...)
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	ip = append(ip, tcp...)
+	eth := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(eth[12:14], 0x0800)
+	return append(eth, ip...)
+}
+
+func buildPcap(segments []testSegment) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], pcap.LinkTypeEthernet)
+	buf.Write(header)
+	for i, s := range segments {
+		data := ethernetFrame(s)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], 1700000000)
+		binary.LittleEndian.PutUint32(record[4:8], uint32(i*1000))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(data)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(data)))
+		buf.Write(record)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func ngBlock(blockType uint32, body []byte) []byte {
+	padded := append(body[:len(body):len(body)], make([]byte, (4-len(body)%4)%4)...)
+	total := uint32(12 + len(padded))
+	b := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(b[0:4], blockType)
+	binary.LittleEndian.PutUint32(b[4:8], total)
+	b = append(b, padded...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+func buildPcapNG(segments []testSegment) []byte {
+	var buf bytes.Buffer
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xffffffffffffffff)
+	buf.Write(ngBlock(0x0a0d0d0a, shb))
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], pcap.LinkTypeEthernet)
+	// if_tsresol: nanoseconds
+	idb = append(idb, 9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0)
+	buf.Write(ngBlock(1, idb))
+	for i, s := range segments {
+		data := ethernetFrame(s)
+		ts := uint64(time.Unix(1700000000, int64(i)*1000).UnixNano())
+		epb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(epb[4:8], uint32(ts>>32))
+		binary.LittleEndian.PutUint32(epb[8:12], uint32(ts))
+		binary.LittleEndian.PutUint32(epb[12:16], uint32(len(data)))
+		binary.LittleEndian.PutUint32(epb[16:20], uint32(len(data)))
+		buf.Write(ngBlock(6, append(epb, data...)))
+	}
+	return buf.Bytes()
+}
+
+const (
+	testRequest  = "2300120231019    120000AOlib|AAP001|ACterm|ADpass|AY1AZ"
+	testResponse = "24              00120231019    120000AOlib|AAP001|AEAlice|BLY|AY1AZ"
+)
+
+func conversation() []testSegment {
+	request := string(sip2.BuildFrame([]byte(testRequest[:len(testRequest)-5]), 1))
+	response := string(sip2.BuildFrame([]byte(testResponse[:len(testResponse)-5]), 1)) + "\n"
+	return []testSegment{
+		{fromSC: true, seq: 999, flags: 0x02},
+		{fromSC: false, seq: 4999, flags: 0x12},
+		{fromSC: true, seq: 1000, payload: request[:10]},
+		// out of order
+		{fromSC: true, seq: 1020, payload: request[20:]},
+		{fromSC: true, seq: 1010, payload: request[10:20]},
+		// retransmission
+		{fromSC: true, seq: 1000, payload: request[:20]},
+		{fromSC: false, seq: 5000, payload: response[:30]},
+		{fromSC: false, seq: 5030, payload: response[30:]},
+		{fromSC: true, seq: 1000 + uint32(len(request)), payload: "9900302.00AY2AZ"},
+	}
+}
+
+func TestReadMessages(t *testing.T) {
+	captures := map[string][]byte{
+		"pcap":   buildPcap(conversation()),
+		"pcapng": buildPcapNG(conversation()),
+	}
+	for name, capture := range captures {
+		t.Run(name, func(t *testing.T) {
+			messages, err := pcap.ReadMessages(bytes.NewReader(capture), 6001)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 3 {
+				t.Fatalf("want 3 messages, got %d", len(messages))
+			}
+			request, response, partial := messages[0], messages[1], messages[2]
+			if !request.FromSC || request.Src != "10.0.0.5:51234" || request.Dst != "10.0.0.9:6001" {
+				t.Errorf("unexpected request endpoints: %+v", request)
+			}
+			if response.FromSC || request.Partial || response.Partial {
+				t.Errorf("unexpected response flags: %+v", response)
+			}
+			if !partial.Partial || string(partial.Frame) != "9900302.00AY2AZ" {
+				t.Errorf("unexpected partial message: %+v", partial)
+			}
+			d := sip2.Dissect(request.Frame)
+			if d.CommandID != "23" || d.Type != "PatronStatusRequest" || d.Checksum != sip2.ChecksumOK || d.Sequence != 1 || d.Error != "" {
+				t.Errorf("unexpected request dissection: %+v", d)
+			}
+			d = sip2.Dissect(response.Frame)
+			if d.CommandID != "24" || d.Checksum != sip2.ChecksumOK || d.Error != "" {
+				t.Errorf("unexpected response dissection: %+v", d)
+			}
+		})
+	}
+}
+
+func TestDissectBadChecksum(t *testing.T) {
+	frame := sip2.BuildFrame([]byte("9900302.00XXunknown|"), 3)
+	frame[len(frame)-2] ^= 1
+	d := sip2.Dissect(frame)
+	if d.Checksum != sip2.ChecksumBad {
+		t.Errorf("want bad checksum, got %s", d.Checksum)
+	}
+	if len(d.UnknownFields) != 1 || d.UnknownFields[0] != "XX" {
+		t.Errorf("want unknown field XX, got %v", d.UnknownFields)
+	}
+}
+
+func TestAssemblerGapAndClose(t *testing.T) {
+	assembler := pcap.NewAssembler(6001)
+	segment := func(seq uint32, flags uint8, payload string) *pcap.Segment {
+		return &pcap.Segment{Src: "10.0.0.5:51234", Dst: "10.0.0.9:6001", SrcPort: 51234, DstPort: 6001, Seq: seq, Flags: flags, Payload: []byte(payload)}
+	}
+	assembler.Add(segment(999, 0x02, ""))
+	if messages := assembler.Add(segment(1000, 0, "9900302.00AY1AZFCA5\r2300")); len(messages) != 1 || messages[0].Partial {
+		t.Fatalf("want the complete frame, got %+v", messages)
+	}
+	// bytes 1024 to 1029 are missing from the capture
+	if messages := assembler.Add(segment(1030, 0, "AOlib|")); len(messages) != 0 {
+		t.Fatalf("want the segment after the gap buffered, got %+v", messages)
+	}
+	// FIN ends the stream, the bytes around the gap are returned as partial frames
+	messages := assembler.Add(segment(1036, 0x11, "AAP001"))
+	if len(messages) != 2 || !messages[0].Partial || string(messages[0].Frame) != "2300" || !messages[1].Partial || string(messages[1].Frame) != "AOlib|AAP001" {
+		t.Fatalf("unexpected messages at FIN: %+v", messages)
+	}
+	if messages = assembler.Flush(); len(messages) != 0 {
+		t.Fatalf("want nothing left after FIN, got %+v", messages)
+	}
+	// RST drops the stream, a new one starts at the next segment
+	assembler.Add(segment(5000, 0, "9900"))
+	if messages = assembler.Add(segment(5004, 0x04, "")); len(messages) != 1 || string(messages[0].Frame) != "9900" {
+		t.Fatalf("unexpected messages at RST: %+v", messages)
+	}
+}
@@ -0,0 +1,322 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+)
+
+type Segment struct {
+	Time    time.Time
+	Src     string
+	Dst     string
+	SrcPort int
+	DstPort int
+	Seq     uint32
+	Flags   uint8
+	Payload []byte
+}
+
+// DecodeSegment returns nil when the packet does not carry a TCP segment.
+func DecodeSegment(p *Packet) *Segment {
+	data := p.Data
+	var ethType uint16
+	switch p.LinkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		ethType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for (ethType == 0x8100 || ethType == 0x88a8) && len(data) >= 4 {
+			ethType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return nil
+		}
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		data = data[4:]
+		ethType = 0x0800
+		if family != 2 {
+			ethType = 0x86dd
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		ethType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case LinkTypeSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		ethType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6, 12:
+		if len(data) < 1 {
+			return nil
+		}
+		ethType = 0x0800
+		if data[0]>>4 == 6 {
+			ethType = 0x86dd
+		}
+	default:
+		return nil
+	}
+	var src, dst net.IP
+	switch ethType {
+	case 0x0800:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return nil
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		fragment := binary.BigEndian.Uint16(data[6:8])
+		if data[9] != 6 || fragment&0x3fff != 0 || headerLen < 20 || len(data) < headerLen {
+			return nil
+		}
+		if totalLen >= headerLen && totalLen < len(data) {
+			data = data[:totalLen]
+		}
+		src, dst, data = net.IP(data[12:16]), net.IP(data[16:20]), data[headerLen:]
+	case 0x86dd:
+		if len(data) < 40 || data[0]>>4 != 6 {
+			return nil
+		}
+		next := data[6]
+		payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:]
+		if payloadLen <= len(data) {
+			data = data[:payloadLen]
+		}
+		for next == 0 || next == 43 || next == 60 {
+			if len(data) < 8 {
+				return nil
+			}
+			extLen := (int(data[1]) + 1) * 8
+			if len(data) < extLen {
+				return nil
+			}
+			next, data = data[0], data[extLen:]
+		}
+		if next != 6 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if len(data) < 20 {
+		return nil
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || len(data) < offset {
+		return nil
+	}
+	srcPort := int(binary.BigEndian.Uint16(data[0:2]))
+	dstPort := int(binary.BigEndian.Uint16(data[2:4]))
+	return &Segment{
+		Time:    p.Time,
+		Src:     net.JoinHostPort(src.String(), strconv.Itoa(srcPort)),
+		Dst:     net.JoinHostPort(dst.String(), strconv.Itoa(dstPort)),
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Seq:     binary.BigEndian.Uint32(data[4:8]),
+		Flags:   data[13],
+		Payload: data[offset:],
+	}
+}
+
+// Message is a SIP2 frame taken out of a reassembled TCP stream.
+type Message struct {
+	Time time.Time `json:"time"`
+	Src  string    `json:"src"`
+	Dst  string    `json:"dst"`
+	// FromSC is set for the messages sent to a SIP port, i.e. by the SC.
+	FromSC bool   `json:"from_sc"`
+	Frame  []byte `json:"-"`
+	// Partial is set for the bytes left in a stream without a terminating carriage return,
+	// and for those cut by a gap in the capture.
+	Partial bool `json:"partial,omitempty"`
+}
+
+type flow struct {
+	src     string
+	dst     string
+	fromSC  bool
+	started bool
+	next    uint32
+	pending map[uint32][]byte
+	buffer  []byte
+}
+
+// Assembler reassembles the TCP streams from or to the SIP ports and splits them into frames.
+type Assembler struct {
+	ports map[int]bool
+	flows map[string]*flow
+	order []string
+}
+
+func NewAssembler(ports ...int) *Assembler {
+	a := &Assembler{ports: make(map[int]bool), flows: make(map[string]*flow)}
+	for _, port := range ports {
+		a.ports[port] = true
+	}
+	return a
+}
+
+// Add feeds a segment and returns the frames it completes.
+func (a *Assembler) Add(seg *Segment) []Message {
+	if !a.ports[seg.SrcPort] && !a.ports[seg.DstPort] {
+		return nil
+	}
+	key := seg.Src + ">" + seg.Dst
+	f, ok := a.flows[key]
+	if !ok {
+		f = &flow{src: seg.Src, dst: seg.Dst, fromSC: a.ports[seg.DstPort], pending: make(map[uint32][]byte)}
+		a.flows[key] = f
+		a.order = append(a.order, key)
+	}
+	if seg.Flags&flagSYN != 0 {
+		f.started, f.next, f.buffer = true, seg.Seq+1, f.buffer[:0]
+		return nil
+	}
+	var messages []Message
+	if len(seg.Payload) > 0 {
+		messages = f.add(seg)
+	}
+	// the stream ends, what is left of it is partial
+	if seg.Flags&(flagFIN|flagRST) != 0 {
+		messages = append(messages, f.drain(seg.Time)...)
+		f.started = false
+	}
+	return messages
+}
+
+func (f *flow) add(seg *Segment) []Message {
+	if !f.started {
+		f.started, f.next = true, seg.Seq
+	}
+	if diff := int32(seg.Seq - f.next); diff > 0 {
+		if len(f.pending[seg.Seq]) < len(seg.Payload) {
+			f.pending[seg.Seq] = append([]byte(nil), seg.Payload...)
+		}
+		return nil
+	}
+	f.append(seg.Seq, seg.Payload)
+	for {
+		found := false
+		for seq, payload := range f.pending {
+			if int32(seq-f.next) <= 0 {
+				delete(f.pending, seq)
+				f.append(seq, payload)
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return f.frames(seg.Time)
+}
+
+func (f *flow) append(seq uint32, payload []byte) {
+	overlap := int(f.next - seq)
+	if overlap >= len(payload) {
+		return
+	}
+	f.buffer = append(f.buffer, payload[overlap:]...)
+	f.next = seq + uint32(len(payload))
+}
+
+func (f *flow) frames(t time.Time) []Message {
+	var messages []Message
+	for {
+		f.buffer = bytes.TrimLeft(f.buffer, "\n")
+		i := bytes.IndexByte(f.buffer, '\r')
+		if i < 0 {
+			return messages
+		}
+		frame := append([]byte(nil), f.buffer[:i+1]...)
+		f.buffer = f.buffer[i+1:]
+		messages = append(messages, Message{Time: t, Src: f.src, Dst: f.dst, FromSC: f.fromSC, Frame: frame})
+	}
+}
+
+// drain returns the bytes left in the flow as partial messages. The segments buffered after
+// a gap are appended in order, a gap ends the partial message before it.
+func (f *flow) drain(t time.Time) []Message {
+	seqs := make([]uint32, 0, len(f.pending))
+	for seq := range f.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return int32(seqs[i]-seqs[j]) < 0 })
+	var messages []Message
+	for _, seq := range seqs {
+		if int32(seq-f.next) > 0 {
+			messages = append(messages, f.partial(t)...)
+			f.next = seq
+		}
+		f.append(seq, f.pending[seq])
+		delete(f.pending, seq)
+	}
+	return append(messages, f.partial(t)...)
+}
+
+func (f *flow) partial(t time.Time) []Message {
+	f.buffer = bytes.TrimLeft(f.buffer, "\n")
+	if len(f.buffer) == 0 {
+		return nil
+	}
+	msg := Message{Time: t, Src: f.src, Dst: f.dst, FromSC: f.fromSC, Frame: f.buffer, Partial: true}
+	f.buffer = nil
+	return []Message{msg}
+}
+
+// Flush returns the incomplete frames left in the streams, in the order the streams were
+// seen: the bytes without a terminating carriage return and those around the gaps of the
+// capture, as partial messages.
+func (a *Assembler) Flush() []Message {
+	var messages []Message
+	for _, key := range a.order {
+		messages = append(messages, a.flows[key].drain(time.Time{})...)
+	}
+	return messages
+}
+
+// ReadMessages reads a whole capture and returns the SIP2 frames exchanged on the given ports.
+func ReadMessages(r io.Reader, ports ...int) ([]Message, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	assembler := NewAssembler(ports...)
+	var messages []Message
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return messages, fmt.Errorf("pcap.ReadMessages: %s", err)
+		}
+		seg := DecodeSegment(packet)
+		if seg == nil {
+			continue
+		}
+		messages = append(messages, assembler.Add(seg)...)
+	}
+	return append(messages, assembler.Flush()...), nil
+}
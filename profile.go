@@ -0,0 +1,109 @@
+package sip2
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// APIKeyHeader is the request header a client sends its API key in.
+const APIKeyHeader = "X-API-Key"
+
+// Profile holds the ACS credentials of a class of clients, selected by the API key they
+// send, the id of the api_keys entry they authenticated with (HMAC signed requests
+// included), the name of their Credential or the common name of their TLS client
+// certificate. The credentials are set on
+// every request by the gateway and clients may not send other values, Defaults only fill
+// the fields a client leaves out.
+type Profile struct {
+	Name             string            `json:"name"`
+	APIKey           string            `json:"api_key"`
+	KeyID            string            `json:"key_id"`
+	ClientCertCN     string            `json:"client_cert_cn"`
+	InstitutionID    string            `json:"institution_id"`
+	TerminalPassword string            `json:"terminal_password"`
+	LocationCode     string            `json:"location_code"`
+	Defaults         map[string]string `json:"defaults"`
+}
+
+// WithProfiles makes every request select one of profiles, the requests matching none are
+// rejected with ErrUnauthorized.
+func WithProfiles(profiles []Profile) Option {
+	return func(ss *SIPServer) {
+		ss.profiles = profiles
+	}
+}
+
+// selectProfile returns nil when the server has no profiles.
+func (ss *SIPServer) selectProfile(r *http.Request) (*Profile, error) {
+	if len(ss.profiles) == 0 {
+		return nil, nil
+	}
+	key := r.Header.Get(APIKeyHeader)
+	cn := ClientCertCN(r)
+	cred, _ := CredentialFromContext(r.Context())
+	if cred == nil {
+		cred = &Credential{}
+	} else if cred.ClientCertCN != "" {
+		cn = cred.ClientCertCN
+	}
+	for i := range ss.profiles {
+		p := &ss.profiles[i]
+		if key != "" && p.APIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(p.APIKey)) == 1 {
+			return p, nil
+		}
+		if cred.KeyID != "" && p.KeyID == cred.KeyID {
+			return p, nil
+		}
+		if cred.Name != "" && p.Name == cred.Name {
+			return p, nil
+		}
+		if cn != "" && p.ClientCertCN == cn {
+			return p, nil
+		}
+	}
+	return nil, newError(ErrUnauthorized, "no profile for this client")
+}
+
+// applyDefaults is called before the client values are read into req.
+func (p *Profile) applyDefaults(req interface{}) error {
+	if p == nil {
+		return nil
+	}
+	for name, value := range p.Defaults {
+		if !HasField(req, name) {
+			continue
+		}
+		err := SetField(req, name, value)
+		if err != nil {
+			return newError(ErrValidation, fmt.Sprintf("profile %s: %s", p.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// applyCredentials is called after the client values are read into req, a client sending
+// another value than the profile's is refused.
+func (p *Profile) applyCredentials(req interface{}) error {
+	if p == nil {
+		return nil
+	}
+	val := reflect.ValueOf(req).Elem()
+	for _, field := range [][3]string{
+		{"institution_id", "InstitutionID", p.InstitutionID},
+		{"terminal_password", "TerminalPassword", p.TerminalPassword},
+		{"location_code", "LocationCode", p.LocationCode},
+	} {
+		name, value := field[0], field[2]
+		if value == "" || !HasField(req, name) {
+			continue
+		}
+		if sent := stringField(val, field[1]); sent != "" && sent != value {
+			return newError(ErrForbidden, name+" is set by the gateway")
+		}
+		sv := StrValue(value)
+		val.FieldByName(field[1]).Field(0).Set(reflect.ValueOf(&sv))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package sip2
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readOnlyMethods are the methods of the JSON API limited by the read budgets, the others
+// by the write budgets.
+var readOnlyMethods = map[string]bool{
+	"query_patron_status":      true,
+	"query_patron_information": true,
+	"query_item_information":   true,
+	"query_sc_status":          true,
+}
+
+// rateLimiter holds a token bucket per scope, class and client.
+type rateLimiter struct {
+	cfg     RateLimitConfig
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// WithRateLimits limits the requests per authenticated API key, per terminal and per patron,
+// see RateLimitConfig. The limits are checked before a pool connection is taken.
+func WithRateLimits(cfg RateLimitConfig) Option {
+	return func(ss *SIPServer) {
+		ss.limiter = &rateLimiter{cfg: cfg, buckets: make(map[string]*tokenBucket), now: time.Now}
+	}
+}
+
+// checkRateLimits sets the Retry-After header and returns an ErrRateLimited error when a
+// budget of the request is spent.
+func (ss *SIPServer) checkRateLimits(header http.Header, r *http.Request, method string, req interface{}) error {
+	if ss.limiter == nil {
+		return nil
+	}
+	retryAfter := ss.limiter.allow(r, method, req)
+	if retryAfter <= 0 {
+		return nil
+	}
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return newError(ErrRateLimited, "rate limit exceeded, retry in "+retryAfter.Round(time.Second).String())
+}
+
+// allow takes a token from every bucket of the request, or none when one of them is
+// empty, and returns how long to wait in that case.
+func (rl *rateLimiter) allow(r *http.Request, method string, req interface{}) time.Duration {
+	class := "write"
+	if readOnlyMethods[method] {
+		class = "read"
+	}
+	type scope struct {
+		name   string
+		client string
+		budget RateBudget
+	}
+	scopes := []scope{{"terminal", terminalOf(r), rl.cfg.PerTerminal}}
+	if cred, ok := CredentialFromContext(r.Context()); ok {
+		scopes = append(scopes, scope{"key", cred.Name, rl.cfg.PerKey})
+	}
+	if HasField(req, "patron_id") {
+		if patronID := stringField(reflect.ValueOf(req).Elem(), "PatronID"); patronID != "" {
+			scopes = append(scopes, scope{"patron", patronID, rl.cfg.PerPatron})
+		}
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.prune(now)
+	buckets := make([]*tokenBucket, 0, len(scopes))
+	var wait time.Duration
+	for _, s := range scopes {
+		limit := s.budget.Write
+		if class == "read" {
+			limit = s.budget.Read
+		}
+		if limit.Rate <= 0 {
+			continue
+		}
+		key := s.name + "/" + class + "/" + s.client
+		b, ok := rl.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(limit.burst()), last: now, limit: limit}
+			rl.buckets[key] = b
+		}
+		b.refill(now)
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.burst()), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// prune drops the full buckets once a minute, they are the same as new ones.
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.pruned) < time.Minute {
+		return
+	}
+	rl.pruned = now
+	for key, b := range rl.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.burst()) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// terminalOf identifies the terminal of a request by its client certificate, or else its
+// address.
+func terminalOf(r *http.Request) string {
+	if cn := ClientCertCN(r); cn != "" {
+		return cn
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,149 @@
+package sip2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DirectionRequest  = "request"
+	DirectionResponse = "response"
+)
+
+// DefaultRedactedFields are the fields hidden from the transcripts and the logs: the terminal,
+// patron and login passwords, the login user id and the personal name, address, email and
+// phone of the patron.
+var DefaultRedactedFields = []string{"AC", "AD", "CO", "CN", "AE", "BD", "BE", "BF"}
+
+// Record is one raw frame of a transcript.
+type Record struct {
+	Time      time.Time `json:"time"`
+	ConnID    string    `json:"conn_id"`
+	Direction string    `json:"direction"`
+	Frame     string    `json:"frame"`
+}
+
+// Recorder writes the frames exchanged by a ClientPool as a JSONL transcript.
+type Recorder struct {
+	mu       sync.Mutex
+	w        io.Writer
+	closer   io.Closer
+	redacted []string
+}
+
+// NewRecorder redacts the values of the given field ids, DefaultRedactedFields when none is given.
+func NewRecorder(w io.Writer, redactedFields ...string) *Recorder {
+	if len(redactedFields) == 0 {
+		redactedFields = DefaultRedactedFields
+	}
+	return &Recorder{w: w, redacted: redactedFields}
+}
+
+// NewRawRecorder records the frames as they are exchanged, secrets and checksums included.
+func NewRawRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+func NewFileRecorder(path string, redactedFields ...string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f, redactedFields...)
+	r.closer = f
+	return r, nil
+}
+
+func (r *Recorder) Record(connID, direction string, frame []byte) error {
+	record := Record{
+		Time:      time.Now(),
+		ConnID:    connID,
+		Direction: direction,
+		Frame:     string(redactFrame(frame, r.redacted)),
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(append(b, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+func ReadTranscript(r io.Reader) ([]Record, error) {
+	records := make([]Record, 0, 64)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record Record
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func LoadTranscript(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTranscript(f)
+}
+
+// redactFrame returns a copy of a frame with the values of the variable fields of ids
+// replaced by ***, the checksum and the line terminator are left as they were. Everything
+// after the command id is replaced in a frame of an unknown command.
+func redactFrame(frame []byte, ids []string) []byte {
+	if len(ids) == 0 {
+		return frame
+	}
+	trimmed := bytes.TrimLeft(frame, "\r\n")
+	body, _, _ := ParseFrame(trimmed, false)
+	if len(body) < 2 {
+		return frame
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(frame)))
+	out.Write(frame[:len(frame)-len(trimmed)])
+	fixed := fixedLength(string(body[:2]))
+	if fixed < 0 || fixed > len(body) {
+		out.Write(body[:2])
+		out.WriteString("***")
+		out.Write(trimmed[len(body):])
+		return out.Bytes()
+	}
+	out.Write(body[:fixed])
+	for i, piece := range bytes.Split(body[fixed:], []byte("|")) {
+		if i > 0 {
+			out.WriteByte('|')
+		}
+		if len(piece) >= 2 && oneOf(string(piece[:2]), ids) {
+			out.Write(piece[:2])
+			out.WriteString("***")
+			continue
+		}
+		out.Write(piece)
+	}
+	out.Write(trimmed[len(body):])
+	return out.Bytes()
+}
@@ -0,0 +1,88 @@
+package sip2_test
+
+import (
+	"bytes"
+	"context"
+	"sip2"
+	"sip2/sip2test"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	transcript := &bytes.Buffer{}
+	pool := newMockPool(t, startMockACS(t))
+	pool.SetRecorder(sip2.NewRecorder(transcript))
+	recorded, err := patronStatusWithPassword(pool, "P001", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(transcript.String(), "1234") {
+		t.Fatalf("patron password not redacted: %s", transcript)
+	}
+	records, err := sip2.ReadTranscript(transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Direction != sip2.DirectionRequest || records[0].ConnID != records[1].ConnID {
+		t.Fatalf("unexpected transcript: %+v", records)
+	}
+	replay, err := sip2test.StartReplayACS(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	replayPool, err := sip2.NewClientPool(replay.Host(), replay.Port(), 1, 1, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		replayPool.Close(ctx)
+	}()
+	replayed, err := patronStatusWithPassword(replayPool, "P001", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the personal name is redacted in the transcript like the passwords
+	if *replayed.PersonalName.StrValue != "***" || *replayed.PatronStatus.StrValue != *recorded.PatronStatus.StrValue {
+		t.Fatal("replayed response differs from the recorded one")
+	}
+	if replay.Remaining() != 0 {
+		t.Fatalf("%d exchanges not replayed", replay.Remaining())
+	}
+}
+
+func TestRawRecorder(t *testing.T) {
+	transcript := &bytes.Buffer{}
+	pool := newMockPool(t, startMockACS(t))
+	pool.SetRecorder(sip2.NewRawRecorder(transcript))
+	if _, err := patronStatusWithPassword(pool, "P001", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	records, err := sip2.ReadTranscript(transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if _, _, err = sip2.ParseFrame([]byte(strings.TrimRight(record.Frame, "\n")), true); err != nil {
+			t.Fatalf("frame %q not recorded as exchanged: %s", record.Frame, err)
+		}
+	}
+	if len(records) != 2 || !strings.Contains(records[0].Frame, "|AD1234|") {
+		t.Fatalf("unexpected transcript: %+v", records)
+	}
+}
+
+func patronStatusWithPassword(pool *sip2.ClientPool, patronID, password string) (*sip2.PatronStatusResponse, error) {
+	req := sip2.NewPatronStatusRequest()
+	*req.PatronID.StrValue = sip2.StrValue(patronID)
+	*req.PatronPassword.StrValue = sip2.StrValue(password)
+	resp, err := pool.ReliableCommunicate(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*sip2.PatronStatusResponse), nil
+}
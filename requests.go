@@ -2,7 +2,11 @@ package sip2
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 )
 
 type LANG int
@@ -51,12 +55,31 @@ const (
 	JPY CURRENCY = "JPY"
 )
 
+var RequestMap = map[string]reflect.Type{
+	"23": reflect.TypeOf(PatronStatusRequest{}),
+	"63": reflect.TypeOf(PatronInformationRequest{}),
+	"17": reflect.TypeOf(ItemInformationRequest{}),
+	"11": reflect.TypeOf(CheckoutRequest{}),
+	"09": reflect.TypeOf(CheckinRequest{}),
+	"01": reflect.TypeOf(BlockPatronRequest{}),
+	"99": reflect.TypeOf(SCStatusRequest{}),
+	"93": reflect.TypeOf(LoginRequest{}),
+	"97": reflect.TypeOf(ResendRequest{}),
+	"35": reflect.TypeOf(EndPatronSessionRequest{}),
+	"37": reflect.TypeOf(FeePaidRequest{}),
+	"19": reflect.TypeOf(ItemStatusUpdateRequest{}),
+	"25": reflect.TypeOf(PatronEnableRequest{}),
+	"15": reflect.TypeOf(HoldRequest{}),
+	"29": reflect.TypeOf(RenewRequest{}),
+	"65": reflect.TypeOf(RenewAllRequest{}),
+}
+
 type PatronStatusRequest struct {
 	CommandID        `json:"command_id"`
 	Language         `json:"language"`
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	PatronPassword   `json:"patron_password"`
 }
@@ -74,7 +97,7 @@ type PatronInformationRequest struct {
 	TransactionDate  `json:"transaction_date"`
 	Summary          `json:"summary"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	PatronPassword   `json:"patron_password"`
 	StartItem        `json:"start_item"`
@@ -92,7 +115,7 @@ type ItemInformationRequest struct {
 	CommandID        `json:"command_id"`
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
-	ItemID           `json:"item_id"`
+	ItemID           `json:"item_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 }
 
@@ -110,8 +133,8 @@ type CheckoutRequest struct {
 	TransactionDate  `json:"transaction_date"`
 	NBDueDate        `json:"nb_due_date"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
-	ItemID           `json:"item_id"`
+	PatronID         `json:"patron_id" validate:"required"`
+	ItemID           `json:"item_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	ItemProperties   `json:"item_properites"`
 	PatronPassword   `json:"patron_password"`
@@ -133,7 +156,7 @@ type CheckinRequest struct {
 	ReturnDate       `json:"return_date"`
 	CurrentLocation  `json:"current_location"`
 	InstitutionID    `json:"institution_id"`
-	ItemID           `json:"item_id"`
+	ItemID           `json:"item_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	ItemProperties   `json:"item_properties"`
 	Cancel           `json:"cancel"`
@@ -152,7 +175,7 @@ type BlockPatronRequest struct {
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
 	BlockedCardMsg   `json:"blocked_card_msg"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 }
 
@@ -165,7 +188,7 @@ func NewBlockPatronRequest() *BlockPatronRequest {
 
 type SCStatusRequest struct {
 	CommandID       `json:"command_id"`
-	StatusCode      `json:"status_code"`
+	StatusCode      `json:"status_code" validate:"oneof=0 1 2"`
 	MaxPrintWidth   `json:"max_print_width"`
 	ProtocolVersion `json:"protocal_version"`
 }
@@ -179,9 +202,9 @@ func NewSCStatusRequest() *SCStatusRequest {
 
 type LoginRequest struct {
 	CommandID     `json:"command_id"`
-	UIDAlgorithm  `json:"uid_algorithm"`
-	PWDAlgorithm  `json:"pwd_algorithm"`
-	LoginUserID   `json:"login_user_id"`
+	UIDAlgorithm  `json:"uid_algorithm" validate:"oneof=0"`
+	PWDAlgorithm  `json:"pwd_algorithm" validate:"oneof=0"`
+	LoginUserID   `json:"login_user_id" validate:"required"`
 	LoginPassword `json:"login_password"`
 	LocationCode  `json:"location_code"`
 }
@@ -194,7 +217,7 @@ func NewLoginRequest() *LoginRequest {
 }
 
 type ResendRequest struct {
-	*CommandID `json:"command_id"`
+	CommandID `json:"command_id"`
 }
 
 func NewResendRequest() *ResendRequest {
@@ -208,7 +231,7 @@ type EndPatronSessionRequest struct {
 	CommandID        `json:"command_id"`
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	PatronPassword   `json:"patron_password"`
 }
@@ -224,11 +247,11 @@ type FeePaidRequest struct {
 	CommandID        `json:"command_id"`
 	TransactionDate  `json:"transaction_date"`
 	FeeType          `json:"fee_type"`
-	PaymentType      `json:"payment_type"`
+	PaymentType      `json:"payment_type" validate:"oneof=0 1 2"`
 	CurrencyType     `json:"currency_type"`
-	FeeAmount        `json:"fee_amount"`
+	FeeAmount        `json:"fee_amount" validate:"required"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	FeeID            `json:"fee_id"`
 	TransactionID    `json:"transaction_id"`
@@ -245,7 +268,7 @@ type ItemStatusUpdateRequest struct {
 	CommandID        `json:"command_id"`
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
-	ItemID           `json:"item_id"`
+	ItemID           `json:"item_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	ItemProperties   `json:"item_properties"`
 }
@@ -261,7 +284,7 @@ type PatronEnableRequest struct {
 	CommandID        `json:"command_id"`
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	TerminalPassword `json:"terminal_password"`
 	PatronPassword   `json:"patron_password"`
 }
@@ -273,14 +296,21 @@ func NewPatronEnableRequest() *PatronEnableRequest {
 	return req
 }
 
+const (
+	HoldModeAdd    = "+"
+	HoldModeDelete = "-"
+	HoldModeChange = "*"
+)
+
 type HoldRequest struct {
 	CommandID        `json:"command_id"`
+	HoldMode         `json:"hold_mode" validate:"oneof=+ - *"`
 	TransactionDate  `json:"transaction_date"`
 	ExpirationDate   `json:"expiration_date"`
 	PickupLocation   `json:"pickup_location"`
-	HoldType         `json:"hold_type"`
+	HoldType         `json:"hold_type" validate:"oneof=1 2 3 4"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	PatronPassword   `json:"patron_password"`
 	ItemID           `json:"item_id"`
 	TitleID          `json:"title_id"`
@@ -292,6 +322,7 @@ func NewHoldRequest() *HoldRequest {
 	req := &HoldRequest{}
 	InitRequest(req)
 	*(req.CommandID.StrValue) = StrValue("15")
+	*(req.HoldMode.StrValue) = StrValue(HoldModeAdd)
 	return req
 }
 
@@ -302,7 +333,7 @@ type RenewRequest struct {
 	TransactionDate   `json:"transaction_date"`
 	NBDueDate         `json:"nb_due_date"`
 	InstitutionID     `json:"institution_id"`
-	PatronID          `json:"patron_id"`
+	PatronID          `json:"patron_id" validate:"required"`
 	PatronPassword    `json:"patron_password"`
 	ItemID            `json:"item_id"`
 	TitleID           `json:"title_id"`
@@ -322,7 +353,7 @@ type RenewAllRequest struct {
 	CommandID        `json:"command_id"`
 	TransactionDate  `json:"transaction_date"`
 	InstitutionID    `json:"institution_id"`
-	PatronID         `json:"patron_id"`
+	PatronID         `json:"patron_id" validate:"required"`
 	PatronPassword   `json:"patron_password"`
 	TerminalPassword `json:"terminal_password"`
 	FeeAcknowledged  `json:"fee_acknowledged"`
@@ -336,16 +367,99 @@ func NewRenewAllRequest() *RenewAllRequest {
 }
 
 func EncodeRequest(req interface{}) ([]byte, error) {
-	val := reflect.ValueOf(req).Elem()
+	return EncodeRequestSeq(req, 0)
+}
+
+// EncodeRequestSeq builds the frame of a request with the sequence number seq, none when
+// seq < 0.
+func EncodeRequestSeq(req interface{}, seq int) ([]byte, error) {
+	return BuildFrame(encodeFields(req), seq), nil
+}
+
+func encodeFields(msg interface{}) []byte {
+	val := reflect.ValueOf(msg).Elem()
 	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Field(i).Interface().(SipField)
 		id, _, length := field.Info()
 		buffer.Write(field.Encode(id, length))
 	}
-	buffer.WriteString("AY0AZ")
-	buffer.WriteString(genChecksum(buffer.Bytes()))
-	return buffer.Bytes(), nil
+	return buffer.Bytes()
+}
+
+func DecodeRequest(b []byte) (interface{}, error) {
+	if len(b) < 2 {
+		return nil, errors.New("DecodeRequest: message too short")
+	}
+	req, err := GenRequest(string(b[:2]))
+	if err != nil {
+		return nil, err
+	}
+	err = decodeFields(bytes.NewReader(b), req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func GenRequest(commandID string) (interface{}, error) {
+	reqType, ok := RequestMap[commandID]
+	if !ok {
+		return nil, fmt.Errorf("DecodeRequest: %s request not exist", commandID)
+	}
+	req := reflect.New(reqType).Interface()
+	InitRequest(req)
+	return req, nil
+}
+
+// SetField sets the field of a request whose JSON name is name from its text form: the value
+// is decoded as a JSON literal (numbers, booleans) first and as a JSON string then, Y and N
+// are booleans too and lists are comma separated.
+func SetField(req interface{}, name, value string) error {
+	field, ok := fieldByJSONName(reflect.ValueOf(req).Elem(), name)
+	if !ok {
+		return fmt.Errorf("SetField: no field %s", name)
+	}
+	if field.Field(0).IsNil() {
+		field.Field(0).Set(reflect.New(field.Field(0).Type().Elem()))
+	}
+	target := field.Addr().Interface()
+	switch field.Field(0).Interface().(type) {
+	case *StrSliceValue:
+		b, _ := json.Marshal(strings.Split(value, ","))
+		return json.Unmarshal(b, target)
+	case *BoolValue:
+		switch value {
+		case "Y":
+			value = "true"
+		case "N":
+			value = "false"
+		}
+	}
+	if json.Unmarshal([]byte(value), target) == nil {
+		return nil
+	}
+	b, _ := json.Marshal(value)
+	err := json.Unmarshal(b, target)
+	if err != nil {
+		return fmt.Errorf("SetField: invalid %s %q", name, value)
+	}
+	return nil
+}
+
+// HasField reports whether a request has a field whose JSON name is name.
+func HasField(req interface{}, name string) bool {
+	_, ok := fieldByJSONName(reflect.ValueOf(req).Elem(), name)
+	return ok
+}
+
+func fieldByJSONName(val reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < val.NumField(); i++ {
+		if strings.Split(val.Type().Field(i).Tag.Get("json"), ",")[0] == name {
+			return val.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
 }
 
 func InitRequest(req interface{}) {
@@ -39,6 +39,12 @@ type PatronStatusResponse struct {
 	PrintLine           `json:"print_line"`
 }
 
+func NewPatronStatusResponse() *PatronStatusResponse {
+	resp := &PatronStatusResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type CheckoutResponse struct {
 	OK              `json:"ok"`
 	RenewalOK       `json:"renewal_ok"`
@@ -50,7 +56,7 @@ type CheckoutResponse struct {
 	ItemID          `json:"item_id"`
 	TitleID         `json:"title_id"`
 	DueDate         `json:"due_date"`
-	FeeType         `json:"fee_type"`
+	ItemFeeType     `json:"fee_type"`
 	SecurityInhibit `json:"security_inhibit"`
 	CurrencyType    `json:"currency_type"`
 	FeeAmount       `json:"fee_amount"`
@@ -61,6 +67,12 @@ type CheckoutResponse struct {
 	PrintLine       `json:"print_line"`
 }
 
+func NewCheckoutResponse() *CheckoutResponse {
+	resp := &CheckoutResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type CheckinResponse struct {
 	OK                `json:"ok"`
 	Resensitize       `json:"resensitize"`
@@ -79,6 +91,12 @@ type CheckinResponse struct {
 	PrintLine         `json:"print_line"`
 }
 
+func NewCheckinResponse() *CheckinResponse {
+	resp := &CheckinResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type ACSStatusResponse struct {
 	OnlineStatus      `json:"online_status"`
 	CheckinOK         `json:"checkin_ok"`
@@ -98,10 +116,28 @@ type ACSStatusResponse struct {
 	PrintLine         `json:"print_line"`
 }
 
+func NewACSStatusResponse() *ACSStatusResponse {
+	resp := &ACSStatusResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type RequestSCResendResponse struct{}
 
+func NewRequestSCResendResponse() *RequestSCResendResponse {
+	resp := &RequestSCResendResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type LoginResponse struct {
-	*OK `json:"ok"`
+	OK `json:"ok"`
+}
+
+func NewLoginResponse() *LoginResponse {
+	resp := &LoginResponse{}
+	InitResponse(resp)
+	return resp
 }
 
 type EndSessionResponse struct {
@@ -113,6 +149,12 @@ type EndSessionResponse struct {
 	PrintLine       `json:"print_line"`
 }
 
+func NewEndSessionResponse() *EndSessionResponse {
+	resp := &EndSessionResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type FeePaidResponse struct {
 	PaymentAccepted `json:"payment_accepted"`
 	TransactionDate `json:"transaction_date"`
@@ -123,6 +165,12 @@ type FeePaidResponse struct {
 	PrintLine       `json:"print_line"`
 }
 
+func NewFeePaidResponse() *FeePaidResponse {
+	resp := &FeePaidResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type ItemInformationResponse struct {
 	CirculationStatus `json:"circulation_status"`
 	SecurityMarker    `json:"security_maker"`
@@ -148,6 +196,12 @@ type ItemInformationResponse struct {
 	Publisher         `json:"publisher"`
 }
 
+func NewItemInformationResponse() *ItemInformationResponse {
+	resp := &ItemInformationResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type ItemStatusUpdateResponse struct {
 	ItemPropertiesOK `json:"item_properties_ok"`
 	TransactionDate  `json:"transaction_date"`
@@ -158,6 +212,12 @@ type ItemStatusUpdateResponse struct {
 	PrintLine        `json:"print_line"`
 }
 
+func NewItemStatusUpdateResponse() *ItemStatusUpdateResponse {
+	resp := &ItemStatusUpdateResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type PatronEnableResponse struct {
 	PatronStatus        `json:"patron_status"`
 	Language            `json:"language"`
@@ -171,6 +231,12 @@ type PatronEnableResponse struct {
 	PrintLine           `json:"print_line"`
 }
 
+func NewPatronEnableResponse() *PatronEnableResponse {
+	resp := &PatronEnableResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type HoldResponse struct {
 	OK              `json:"ok"`
 	TransactionDate `json:"transaction_date"`
@@ -185,6 +251,12 @@ type HoldResponse struct {
 	PrintLine       `json:"print_line"`
 }
 
+func NewHoldResponse() *HoldResponse {
+	resp := &HoldResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type RenewResponse struct {
 	OK              `json:"ok"`
 	RenewalOK       `json:"renewal_ok"`
@@ -195,7 +267,7 @@ type RenewResponse struct {
 	PatronID        `json:"patron_id"`
 	TitleID         `json:"title_id"`
 	DueDate         `json:"due_date"`
-	FeeType         `json:"fee_type"`
+	ItemFeeType     `json:"fee_type"`
 	SecurityInhibit `json:"security_inhibit"`
 	CurrencyType    `json:"currency_type"`
 	FeeAmount       `json:"fee_amount"`
@@ -206,6 +278,12 @@ type RenewResponse struct {
 	PrintLine       `json:"print_line"`
 }
 
+func NewRenewResponse() *RenewResponse {
+	resp := &RenewResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type RenewAllResponse struct {
 	OK              `json:"ok"`
 	RenewedCount    `json:"renewed_count"`
@@ -218,6 +296,12 @@ type RenewAllResponse struct {
 	PrintLine       `json:"print_line"`
 }
 
+func NewRenewAllResponse() *RenewAllResponse {
+	resp := &RenewAllResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 type PatronInformationResponse struct {
 	PatronStatus          `json:"patron_status"`
 	Language              `json:"language"`
@@ -249,6 +333,12 @@ type PatronInformationResponse struct {
 	PrintLine             `json:"print_line"`
 }
 
+func NewPatronInformationResponse() *PatronInformationResponse {
+	resp := &PatronInformationResponse{}
+	InitResponse(resp)
+	return resp
+}
+
 func classifyFields(resp interface{}) ([]SipField, map[string]SipField) {
 	fixedFields := make([]SipField, 0, 16)
 	variableFields := make(map[string]SipField)
@@ -269,6 +359,9 @@ func decodeVarFields(r *bytes.Reader, varFieldsMap map[string]SipField) error {
 	bs, _ := ioutil.ReadAll(r)
 	fieldBytes := bytes.Split(bs, []byte("|"))
 	for _, fb := range fieldBytes {
+		if len(fb) < 2 {
+			continue
+		}
 		if field, ok := varFieldsMap[string(fb[:2])]; ok {
 			reader := bytes.NewReader(append(fb, '|'))
 			id, _, length := field.Info()
@@ -295,19 +388,41 @@ func (p *ClientPool) DecodeResponse(b []byte) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	fixed, variable := classifyFields(resp)
+	err = decodeFields(reader, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func decodeFields(r *bytes.Reader, msg interface{}) error {
+	fixed, variable := classifyFields(msg)
 	for _, field := range fixed {
 		id, _, length := field.Info()
-		err = field.Decode(reader, id, length)
+		err := field.Decode(r, id, length)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	err = decodeVarFields(reader, variable)
-	if err != nil {
+	return decodeVarFields(r, variable)
+}
+
+func EncodeResponse(resp interface{}, seq int) ([]byte, error) {
+	if err := checkStructPtr(resp); err != nil {
 		return nil, err
 	}
-	return resp, nil
+	if reflect.ValueOf(resp).IsNil() {
+		return nil, errors.New("EncodeResponse: nil response")
+	}
+	respType := reflect.TypeOf(resp).Elem()
+	for commandID, typ := range ResponseMap {
+		if typ == respType {
+			fillResponse(resp)
+			body := append([]byte(commandID), encodeFields(resp)...)
+			return BuildFrame(body, seq), nil
+		}
+	}
+	return nil, fmt.Errorf("EncodeResponse: %s is not a response", respType)
 }
 
 func GenResponse(commandID string) (interface{}, error) {
@@ -328,3 +443,13 @@ func InitResponse(resp interface{}) {
 		field.Set(reflect.New(fieldType))
 	}
 }
+
+func fillResponse(resp interface{}) {
+	val := reflect.ValueOf(resp).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i).Field(0)
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package sip2
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// restRoute maps a resource path onto a request, the {name} segments of a pattern set
+// the request fields of the same JSON name.
+type restRoute struct {
+	// name is the method of the JSON API sending the same request, for the credentials
+	name       string
+	method     string
+	pattern    []string
+	newRequest func() interface{}
+	// fields forced whatever the client sends
+	fixed   map[string]string
+	created bool
+}
+
+var restRoutes = []restRoute{
+	{name: "query_patron_information", method: http.MethodGet, pattern: []string{"patrons", "{patron_id}"}, newRequest: func() interface{} { return NewPatronInformationRequest() }},
+	{name: "query_patron_status", method: http.MethodGet, pattern: []string{"patrons", "{patron_id}", "status"}, newRequest: func() interface{} { return NewPatronStatusRequest() }},
+	{name: "query_item_information", method: http.MethodGet, pattern: []string{"items", "{item_id}"}, newRequest: func() interface{} { return NewItemInformationRequest() }},
+	{name: "check_out", method: http.MethodPost, pattern: []string{"checkouts"}, newRequest: func() interface{} { return NewCheckoutRequest() }, created: true},
+	{name: "check_in", method: http.MethodPost, pattern: []string{"checkins"}, newRequest: func() interface{} { return NewCheckinRequest() }},
+	{name: "fee_paid", method: http.MethodPost, pattern: []string{"patrons", "{patron_id}", "fees", "{fee_id}", "payments"}, newRequest: func() interface{} { return NewFeePaidRequest() }, created: true},
+	{name: "hold", method: http.MethodPost, pattern: []string{"holds"}, newRequest: func() interface{} { return NewHoldRequest() }, fixed: map[string]string{"hold_mode": HoldModeAdd}, created: true},
+	{name: "hold", method: http.MethodDelete, pattern: []string{"holds", "{item_id}"}, newRequest: func() interface{} { return NewHoldRequest() }, fixed: map[string]string{"hold_mode": HoldModeDelete}},
+}
+
+// restPrefixes are the paths the REST routes are registered on.
+var restPrefixes = []string{"/patrons/", "/items/", "/checkouts", "/checkins", "/holds", "/holds/"}
+
+func (rr restRoute) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rr.pattern) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, p := range rr.pattern {
+		if strings.HasPrefix(p, "{") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// RouteREST serves the resource routes: the query string (GET, DELETE) or the JSON body
+// (POST) fill the request, then the path parameters. The HTTP status is derived from the
+// response flags: an unknown patron or item is ErrNotFound, a wrong patron password
+// ErrForbidden and a transaction refused by the ACS ErrRejected.
+func (ss *SIPServer) RouteREST(w http.ResponseWriter, r *http.Request) {
+	start, sw, method := time.Now(), &statusWriter{ResponseWriter: w, status: http.StatusOK}, ""
+	w = sw
+	defer func() {
+		ss.pool.Metrics().observeRequest(method, sw.status, time.Since(start))
+	}()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var route *restRoute
+	var params map[string]string
+	allowed := make([]string, 0, 2)
+	for i := range restRoutes {
+		p, ok := restRoutes[i].match(segments)
+		if !ok {
+			continue
+		}
+		allowed = append(allowed, restRoutes[i].method)
+		if restRoutes[i].method == r.Method {
+			route, params = &restRoutes[i], p
+		}
+	}
+	if route == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			ss.errHandler(w, newError(ErrMethodNotAllowed, "method not allowed"))
+			return
+		}
+		ss.errHandler(w, newError(ErrNotFound, "no such resource"))
+		return
+	}
+	method = route.name
+	SpanFromContext(r.Context()).SetAttribute("sip2.method", method)
+	profile, err := ss.selectProfile(r)
+	if err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	req := route.newRequest()
+	if HasField(req, "transaction_date") {
+		SetField(req, "transaction_date", time.Now().Format("2006-01-02 15:04:05"))
+	}
+	if err = profile.applyDefaults(req); err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		body, err := readBody(r)
+		if err != nil {
+			ss.errHandler(w, err)
+			return
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			err = json.Unmarshal(body, req)
+			if err != nil {
+				ss.errHandler(w, newError(ErrValidation, err.Error()))
+				return
+			}
+		}
+	} else {
+		for name, values := range r.URL.Query() {
+			err := SetField(req, name, values[0])
+			if err != nil {
+				ss.errHandler(w, newError(ErrValidation, err.Error()))
+				return
+			}
+		}
+	}
+	for _, fields := range []map[string]string{params, route.fixed} {
+		for name, value := range fields {
+			err := SetField(req, name, value)
+			if err != nil {
+				ss.errHandler(w, newError(ErrValidation, err.Error()))
+				return
+			}
+		}
+	}
+	if err = profile.applyCredentials(req); err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	if err = ss.authorize(r.Context(), route.name, req); err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	if err = Validate(req); err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	if err = ss.checkRateLimits(w.Header(), r, route.name, req); err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	resp, err := ss.send(r, route.name, req, ss.pool.ReliableCommunicateContext)
+	if err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	if err = restOutcome(req, resp); err != nil {
+		ss.errHandler(w, err)
+		return
+	}
+	status := http.StatusOK
+	if route.created {
+		status = http.StatusCreated
+	}
+	writeREST(w, status, resp)
+}
+
+// restOutcome reports unknown patrons and items and wrong patron passwords on top of the
+// rejected transactions.
+func restOutcome(req, resp interface{}) error {
+	passwordGiven := stringField(reflect.ValueOf(req).Elem(), "PatronPassword") != ""
+	switch r := resp.(type) {
+	case *PatronInformationResponse:
+		return patronOutcome(bool(*r.ValidPatron.BoolValue), bool(*r.ValidPatronPassword.BoolValue), passwordGiven)
+	case *PatronStatusResponse:
+		return patronOutcome(bool(*r.ValidPatron.BoolValue), bool(*r.ValidPatronPassword.BoolValue), passwordGiven)
+	case *ItemInformationResponse:
+		// circulation status 01 (other) without a title is how ACSs answer an unknown item
+		if *r.CirculationStatus.IntValue == 1 && *r.TitleID.StrValue == "" {
+			return newError(ErrNotFound, "item not found")
+		}
+	}
+	return rejection(resp)
+}
+
+func patronOutcome(validPatron, validPassword, passwordGiven bool) error {
+	switch {
+	case !validPatron:
+		return newError(ErrNotFound, "patron not found")
+	case passwordGiven && !validPassword:
+		return newError(ErrForbidden, "invalid patron password")
+	}
+	return nil
+}
+
+// writeREST writes the JSONResponse envelope with the HTTP status as its code.
+func writeREST(w http.ResponseWriter, status int, item interface{}) {
+	resp := NewJSONResponse("2.0", "ok", status)
+	resp.Data.Item = item
+	writeJSON(w, status, resp)
+}
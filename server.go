@@ -1,125 +1,517 @@
 package sip2
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"genjson"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 )
 
+// MethodMap maps the method names of the JSON API to the request constructors.
+var MethodMap = map[string]func() interface{}{
+	"query_patron_status":      func() interface{} { return NewPatronStatusRequest() },
+	"query_patron_information": func() interface{} { return NewPatronInformationRequest() },
+	"query_item_information":   func() interface{} { return NewItemInformationRequest() },
+	"check_out":                func() interface{} { return NewCheckoutRequest() },
+	"check_in":                 func() interface{} { return NewCheckinRequest() },
+	"block_patron":             func() interface{} { return NewBlockPatronRequest() },
+	"query_sc_status":          func() interface{} { return NewSCStatusRequest() },
+	"login":                    func() interface{} { return NewLoginRequest() },
+	"end_patron_session":       func() interface{} { return NewEndPatronSessionRequest() },
+	"fee_paid":                 func() interface{} { return NewFeePaidRequest() },
+	"item_status_update":       func() interface{} { return NewItemStatusUpdateRequest() },
+	"patron_enable":            func() interface{} { return NewPatronEnableRequest() },
+	"hold":                     func() interface{} { return NewHoldRequest() },
+	"renew":                    func() interface{} { return NewRenewRequest() },
+	"renew_all":                func() interface{} { return NewRenewAllRequest() },
+}
+
+type ResponseHeader struct {
+	Version string `json:"version"`
+}
+
+type ResponseData struct {
+	Msg  string `json:"msg"`
+	Code int    `json:"code"`
+	// ErrorCode is the stable code of the SIPError of a failure, see ErrorStatus
+	ErrorCode string        `json:"error_code,omitempty"`
+	ItemList  []interface{} `json:"item_list"`
+	Item      interface{}   `json:"item"`
+	Meta      interface{}   `json:"meta"`
+}
+
+// JSONResponse is the envelope of the responses of the JSON API, SuccessResponse and
+// WriteError are the default writers of SIPServer.
+type JSONResponse struct {
+	Header ResponseHeader `json:"header"`
+	Data   ResponseData   `json:"data"`
+}
+
+func NewJSONResponse(version, msg string, code int) *JSONResponse {
+	return &JSONResponse{
+		Header: ResponseHeader{Version: version},
+		Data: ResponseData{
+			Msg:  msg,
+			Code: code,
+		},
+	}
+}
+
+// ErrorCodeHeader carries the SIPError code of a failure to the error writers of
+// WithErrorFunc, which only get the message and the HTTP status.
+const ErrorCodeHeader = "X-Error-Code"
+
+// ErrorResponse writes the JSON envelope of an error with code as HTTP status, and the
+// error_code of the ErrorCodeHeader of the response when set.
+func ErrorResponse(w http.ResponseWriter, msg string, code int) {
+	errResp := NewJSONResponse("2.0", msg, code)
+	errResp.Data.ErrorCode = w.Header().Get(ErrorCodeHeader)
+	writeJSON(w, code, errResp)
+}
+
+// maxBodySize is the largest request body read by the gateway.
+const maxBodySize = 1 << 20
+
+// readBody reads the body of r, a body over maxBodySize is refused with ErrTooLarge.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, newError(ErrValidation, err.Error())
+	}
+	if len(body) > maxBodySize {
+		return nil, newError(ErrTooLarge, "request body over 1MB")
+	}
+	return body, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp *JSONResponse) {
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func SuccessResponse(w http.ResponseWriter, sipResp interface{}) {
+	resp := NewJSONResponse("2.0", "ok", 200)
+	resp.Data.Item = sipResp
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		WriteError(w, errors.New("SuccessResponse: "+err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResp)
+}
+
 type SIPServer struct {
-	pool     *ClientPool
-	server   *http.Server
-	ctx      context.Context
-	cancel   context.CancelFunc
-	respFunc func(http.ResponseWriter, interface{})
-	errFunc  func(http.ResponseWriter, string, int)
+	pool        *ClientPool
+	mux         *http.ServeMux
+	server      *http.Server
+	ctx         context.Context
+	cancel      context.CancelFunc
+	respFunc    func(http.ResponseWriter, interface{})
+	errHandler  func(http.ResponseWriter, error)
+	profiles    []Profile
+	auth        Authenticator
+	limiter     *rateLimiter
+	idempotency *idempotency
+	offline     *OfflineJournal
+	audit       AuditSink
+	logger      Logger
+	tracer      Tracer
+	handler     http.Handler
 }
 
 func (ss *SIPServer) Route(w http.ResponseWriter, r *http.Request) {
 	newCtx := context.WithValue(r.Context(), "ctx", ss.ctx)
 	r = r.WithContext(newCtx)
-	root := genjson.Parse(r.Body)
-	if root == nil {
-		ss.errFunc(w, "Not valid json format", 405)
+	start, sw, method := time.Now(), &statusWriter{ResponseWriter: w, status: http.StatusOK}, ""
+	w = sw
+	defer func() {
+		ss.pool.Metrics().observeRequest(method, sw.status, time.Since(start))
+	}()
+	profile, err := ss.selectProfile(r)
+	if err != nil {
+		ss.errHandler(w, err)
 		return
 	}
-	method, err := root.QueryString("header.method")
+	body, err := readBody(r)
 	if err != nil {
-		ss.errFunc(w, "No valid method", 405)
+		ss.errHandler(w, err)
 		return
 	}
-	var req interface{}
-	switch method {
-	case "query_patron_status":
-		req = NewPatronStatusRequest()
-	case "query_patron_information":
-		req = NewPatronInformationRequest()
-	case "query_item_information":
-		req = NewItemInformationRequest()
-	case "check_out":
-		req = NewCheckoutRequest()
-	case "check_in":
-		req = NewCheckinRequest()
-	case "block_patron":
-		req = NewBlockPatronRequest()
-	case "query_sc_status":
-		req = NewSCStatusRequest()
-	case "login":
-		req = NewLoginRequest()
-	case "end_patron_session":
-		req = NewEndPatronSessionRequest()
-	case "fee_paid":
-		req = NewFeePaidRequest()
-	case "item_status_update":
-		req = NewItemStatusUpdateRequest()
-	case "patron_enable":
-		req = NewPatronEnableRequest()
-	case "hold":
-		req = NewHoldRequest()
-	case "renew":
-		req = NewRenewRequest()
-	case "renew_all":
-		req = NewRenewAllRequest()
-	default:
-		ss.errFunc(w, "method not exist", 500)
+	root := genjson.Parse(bytes.NewReader(body))
+	if root == nil {
+		ss.errHandler(w, newError(ErrValidation, "Not valid json format"))
 		return
 	}
-	argsNode := root.Query("data")
-	if argsNode == nil {
-		ss.errFunc(w, "data node not exist", 500)
+	method, err = root.QueryString("header.method")
+	if err != nil {
+		ss.errHandler(w, newError(ErrValidation, "No valid method"))
 		return
 	}
-	err = json.Unmarshal([]byte(argsNode.String()), req)
+	SpanFromContext(r.Context()).SetAttribute("sip2.method", method)
+	var data []byte
+	if argsNode := root.Query("data"); argsNode != nil {
+		data = []byte(argsNode.String())
+	}
+	req, err := ss.buildRequest(r, profile, method, data)
 	if err != nil {
-		ss.errFunc(w, err.Error(), 500)
+		ss.errHandler(w, err)
+		return
+	}
+	if err = ss.checkRateLimits(w.Header(), r, method, req); err != nil {
+		ss.errHandler(w, err)
 		return
 	}
-	resp, err := ss.pool.ReliableCommunicate(req)
+	resp, err := ss.send(r, method, req, ss.pool.ReliableCommunicateContext)
 	if err != nil {
-		ss.errFunc(w, err.Error(), 500)
+		ss.errHandler(w, err)
+		return
+	}
+	if err = rejection(resp); err != nil {
+		ss.errHandler(w, err)
 		return
 	}
 	ss.respFunc(w, resp)
 }
 
+// send exchanges a request of method with communicate, through the offline journal when
+// WithOffline is set. The exchanges are audited by the pool for the client of r, send audits
+// the transactions answered offline.
+func (ss *SIPServer) send(r *http.Request, method string, req interface{}, communicate Invoker) (interface{}, error) {
+	start := time.Now()
+	ctx := withAuditClient(r.Context(), clientIdentity(r))
+	var resp interface{}
+	var offline bool
+	var err error
+	if ss.offline == nil {
+		resp, err = communicate(ctx, req)
+	} else {
+		profile, _ := ss.selectProfile(r)
+		resp, offline, err = ss.offline.send(ctx, method, req, profile, communicate)
+	}
+	if offline {
+		ss.logger.Log(LevelInfo, "ACS unreachable, answered offline", F("method", method))
+	}
+	if offline && ss.audit != nil {
+		auditErr := ss.audit.Audit(newAuditRecord(start, clientIdentity(r), method, req, resp, offline, err))
+		if auditErr != nil {
+			ss.logger.Log(LevelError, "audit failed", F("method", method), F("error", auditErr))
+		}
+	}
+	return resp, err
+}
+
+// buildRequest returns the request of a method of the JSON API filled with data, the
+// profile applied, authorized and validated.
+func (ss *SIPServer) buildRequest(r *http.Request, profile *Profile, method string, data []byte) (interface{}, error) {
+	newRequest, ok := MethodMap[method]
+	if !ok {
+		return nil, newError(ErrUnknownMethod, "method not exist")
+	}
+	req := newRequest()
+	err := profile.applyDefaults(req)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, newError(ErrValidation, "data node not exist")
+	}
+	err = json.Unmarshal(data, req)
+	if err != nil {
+		return nil, newError(ErrValidation, err.Error())
+	}
+	if err = profile.applyCredentials(req); err != nil {
+		return nil, err
+	}
+	if err = ss.authorize(r.Context(), method, req); err != nil {
+		return nil, err
+	}
+	if err = Validate(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// rejection returns an ErrRejected error when the OK flag of a transaction response is off.
+func rejection(resp interface{}) error {
+	var ok BoolValue
+	var screenMessage StrValue
+	switch r := resp.(type) {
+	case *CheckoutResponse:
+		ok, screenMessage = *r.OK.BoolValue, *r.ScreenMessage.StrValue
+	case *CheckinResponse:
+		ok, screenMessage = *r.OK.BoolValue, *r.ScreenMessage.StrValue
+	case *RenewResponse:
+		ok, screenMessage = *r.OK.BoolValue, *r.ScreenMessage.StrValue
+	case *RenewAllResponse:
+		ok, screenMessage = *r.OK.BoolValue, *r.ScreenMessage.StrValue
+	case *HoldResponse:
+		ok, screenMessage = *r.OK.BoolValue, *r.ScreenMessage.StrValue
+	case *FeePaidResponse:
+		ok, screenMessage = *r.PaymentAccepted.BoolValue, *r.ScreenMessage.StrValue
+	case *LoginResponse:
+		ok = *r.OK.BoolValue
+	default:
+		return nil
+	}
+	if ok {
+		return nil
+	}
+	if screenMessage == "" {
+		screenMessage = "refused by the ACS"
+	}
+	return newRejectedError(string(screenMessage), resp)
+}
+
+// Option configures a SIPServer built by NewHandler.
+type Option func(*SIPServer)
+
+// WithResponseFunc replaces SuccessResponse as the writer of the successful responses.
+func WithResponseFunc(respFunc func(http.ResponseWriter, interface{})) Option {
+	return func(ss *SIPServer) {
+		ss.respFunc = respFunc
+	}
+}
+
+// WithLogger makes the gateway and its pool log to l, see ClientPool.SetLogger.
+func WithLogger(l Logger) Option {
+	return func(ss *SIPServer) {
+		ss.logger = l
+		ss.pool.SetLogger(l)
+	}
+}
+
+// WithErrorHandler replaces WriteError as the writer of the errors.
+func WithErrorHandler(errHandler func(http.ResponseWriter, error)) Option {
+	return func(ss *SIPServer) {
+		ss.errHandler = errHandler
+	}
+}
+
+// WithErrorFunc writes the errors with errFunc, given the message and the HTTP status of
+// their SIPError, its code is set as the ErrorCodeHeader of the response.
+func WithErrorFunc(errFunc func(http.ResponseWriter, string, int)) Option {
+	return WithErrorHandler(func(w http.ResponseWriter, err error) {
+		status, code := ErrorStatus(err)
+		w.Header().Set(ErrorCodeHeader, code)
+		errFunc(w, err.Error(), status)
+	})
+}
+
+// NewHandler returns the JSON API over an existing pool as an http.Handler, to be mounted in
+// another mux or wrapped by middleware. Shutdown closes the pool but serves nothing else.
+func NewHandler(pool *ClientPool, opts ...Option) *SIPServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	ss := &SIPServer{
+		pool:       pool,
+		mux:        http.NewServeMux(),
+		ctx:        ctx,
+		cancel:     cancel,
+		respFunc:   SuccessResponse,
+		errHandler: WriteError,
+		logger:     nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(ss)
+	}
+	ss.mux.HandleFunc("/", ss.Route)
+	ss.mux.HandleFunc("/batch", ss.RouteBatch)
+	ss.mux.Handle("/metrics", pool.Metrics())
+	for _, prefix := range restPrefixes {
+		ss.mux.HandleFunc(prefix, ss.RouteREST)
+	}
+	ss.handler = ss.mux
+	if ss.idempotency != nil {
+		ss.idempotency.logger = ss.logger
+		ss.handler = ss.idempotency.middleware(ss.errHandler, ss.handler)
+	}
+	if ss.auth != nil {
+		ss.handler = RequireAuth(ss.auth, ss.errHandler, ss.handler)
+	}
+	if ss.tracer != nil {
+		ss.handler = ss.traced(ss.handler)
+	}
+	if ss.offline != nil {
+		ss.offline.logger, ss.offline.profiles = ss.logger, ss.profiles
+		go ss.offline.replayLoop(ss.ctx, pool)
+	}
+	return ss
+}
+
+func (ss *SIPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ss.handler.ServeHTTP(w, r)
+}
+
+// NewSIPServer builds the pool and the HTTP server from a config file around NewHandler,
+// a nil respFunc or errFunc keeps the default writer.
 func NewSIPServer(cfgPath string, respFunc func(http.ResponseWriter, interface{}), errFunc func(http.ResponseWriter, string, int)) (*SIPServer, error) {
 	cfg, err := loadConfig(cfgPath)
 	if err != nil {
 		return nil, err
 	}
-	sipServer := &SIPServer{}
-	pool, err := NewClientPool(cfg.SIPConfig.Host, cfg.SIPConfig.Port, cfg.SIPConfig.PoolSize, cfg.SIPConfig.Timeout, cfg.SIPConfig.RetryTimes, cfg.SIPConfig.ErrorDetection)
+	var acsTLS, serverTLS *tls.Config
+	if cfg.SIPConfig.TLS != nil {
+		acsTLS, err = cfg.SIPConfig.TLS.Load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TLS != nil {
+		serverTLS, err = cfg.TLS.Load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pool, err := NewTLSClientPool(cfg.SIPConfig.Host, cfg.SIPConfig.Port, cfg.SIPConfig.PoolSize, cfg.SIPConfig.Timeout, cfg.SIPConfig.RetryTimes, cfg.SIPConfig.ErrorDetection, acsTLS)
 	if err != nil {
 		return nil, err
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", sipServer.Route)
+	pool.SetEndSessionsOnClose(cfg.SIPConfig.EndSessionsOnClose)
+	level := LevelInfo
+	if cfg.Log != nil {
+		if cfg.Log.Level != "" {
+			level, err = ParseLevel(cfg.Log.Level)
+		}
+		if err == nil {
+			err = pool.SetFrameDebug(cfg.Log.FrameDebug...)
+		}
+		if err != nil {
+			pool.Close(context.Background())
+			return nil, err
+		}
+	}
+	logger := NewTextLogger(os.Stderr, level)
+	pool.SetLogger(logger)
+	if cfg.SIPConfig.LoginUserID != "" {
+		err = pool.Login(cfg.SIPConfig.LoginUserID, cfg.SIPConfig.LoginPassword, cfg.SIPConfig.LocationCode)
+		if err != nil {
+			pool.Close(context.Background())
+			return nil, err
+		}
+	}
+	opts := make([]Option, 0, 10)
+	opts = append(opts, WithLogger(logger))
+	if cfg.Log != nil && cfg.Log.Trace {
+		opts = append(opts, WithTracer(NewLogTracer(logger)))
+	}
+	if cfg.Offline != nil {
+		loanDays, probe := cfg.Offline.LoanDays, cfg.Offline.ProbeInterval
+		if loanDays <= 0 {
+			loanDays = 14
+		}
+		if probe <= 0 {
+			probe = 30
+		}
+		journal, err := NewOfflineJournal(cfg.Offline.Journal, cfg.Offline.Report, time.Duration(loanDays)*24*time.Hour)
+		if err != nil {
+			pool.Close(context.Background())
+			return nil, err
+		}
+		journal.TerminalPassword = cfg.Offline.TerminalPassword
+		opts = append(opts, WithOffline(journal, time.Duration(probe)*time.Second))
+	}
+	if cfg.Idempotency != nil {
+		var store IdempotencyStore = NewMemoryIdempotencyStore()
+		if cfg.Idempotency.File != "" {
+			store, err = NewFileIdempotencyStore(cfg.Idempotency.File)
+			if err != nil {
+				pool.Close(context.Background())
+				return nil, err
+			}
+		}
+		opts = append(opts, WithIdempotency(store, time.Duration(cfg.Idempotency.Window)*time.Second))
+	}
+	if cfg.Audit != nil {
+		auditLog, err := NewAuditLog(cfg.Audit.File, cfg.Audit.MaxBytes)
+		if err != nil {
+			pool.Close(context.Background())
+			return nil, err
+		}
+		opts = append(opts, WithAudit(auditLog))
+	}
+	if cfg.RateLimits != nil {
+		opts = append(opts, WithRateLimits(*cfg.RateLimits))
+	}
+	if len(cfg.APIKeys) > 0 {
+		opts = append(opts, WithAuthenticator(NewKeyAuthenticator(cfg.APIKeys)))
+	}
+	if len(cfg.Profiles) > 0 {
+		opts = append(opts, WithProfiles(cfg.Profiles))
+	}
+	if respFunc != nil {
+		opts = append(opts, WithResponseFunc(respFunc))
+	}
+	if errFunc != nil {
+		opts = append(opts, WithErrorFunc(errFunc))
+	}
+	sipServer := NewHandler(pool, opts...)
 	server := &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
-		Handler:      mux,
+		Addr:         net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:      sipServer,
+		TLSConfig:    serverTLS,
 		ReadTimeout:  time.Duration(cfg.SIPConfig.Timeout)*time.Duration(cfg.SIPConfig.RetryTimes)*time.Second + 5*time.Second,
 		WriteTimeout: time.Duration(cfg.SIPConfig.Timeout)*time.Duration(cfg.SIPConfig.RetryTimes)*time.Second + 5*time.Second,
 	}
 	server.SetKeepAlivesEnabled(true)
-	ctx, cancel := context.WithCancel(context.Background())
-	sipServer.pool = pool
 	sipServer.server = server
-	sipServer.ctx = ctx
-	sipServer.cancel = cancel
-	sipServer.respFunc = respFunc
-	sipServer.errFunc = errFunc
 	return sipServer, nil
 }
 
+// Addr is empty for a SIPServer built by NewHandler.
+func (ss *SIPServer) Addr() string {
+	if ss.server == nil {
+		return ""
+	}
+	return ss.server.Addr
+}
+
 func (ss *SIPServer) ListenAndServe() error {
+	if ss.server == nil {
+		return errors.New("*SIPServer.ListenAndServe: no HTTP server, mount the handler instead")
+	}
+	if ss.server.TLSConfig != nil {
+		return ss.server.ListenAndServeTLS("", "")
+	}
 	return ss.server.ListenAndServe()
 }
 
+// Shutdown stops accepting requests, waits for the ones in flight and closes the pool,
+// the errors of every step are returned together.
 func (ss *SIPServer) Shutdown(ctx context.Context) error {
+	var errs []error
+	if ss.server != nil {
+		err := ss.server.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	ss.cancel()
 	err := ss.pool.Close(ctx)
-	err = ss.server.Shutdown(ctx)
-	return err
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if ss.idempotency != nil {
+		if closer, ok := ss.idempotency.store.(io.Closer); ok {
+			if err = closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if closer, ok := ss.audit.(io.Closer); ok {
+		if err = closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
 }
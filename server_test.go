@@ -1,64 +1,974 @@
-package sip2
+package sip2_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sip2"
+	"sip2/sip2test"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-type ResponseHeader struct {
-	Version string `json:"version"`
+func newMockServer(t *testing.T) *httptest.Server {
+	acs := startMockACS(t)
+	cfgPath := filepath.Join(t.TempDir(), "config.json")
+	cfg := fmt.Sprintf(`{"host": "127.0.0.1", "port": 0, "sip_config": {"host": %q, "port": %d, "pool_size": 2, "timeout": 5, "retry_times": 3, "error_detection": true}}`, acs.Host(), acs.Port())
+	err := ioutil.WriteFile(cfgPath, []byte(cfg), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sipServer, err := sip2.NewSIPServer(cfgPath, sip2.SuccessResponse, sip2.ErrorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(sipServer.Route))
+	t.Cleanup(server.Close)
+	return server
 }
 
-type ResponseData struct {
-	Msg      string        `json:"msg"`
-	Code     int           `json:"code"`
-	ItemList []interface{} `json:"item_list"`
-	Item     interface{}   `json:"item"`
-	Meta     interface{}   `json:"meta"`
+func postMethod(t *testing.T, server *httptest.Server, method string, data string) *sip2.JSONResponse {
+	body := fmt.Sprintf(`{"header": {"method": %q}, "data": %s}`, method, data)
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	jsonResp := &sip2.JSONResponse{}
+	err = json.NewDecoder(resp.Body).Decode(jsonResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonResp
 }
 
-type JSONResponse struct {
-	Header ResponseHeader `json:"header"`
-	Data   ResponseData   `json:"data"`
+func TestServer(t *testing.T) {
+	server := newMockServer(t)
+	resp := postMethod(t, server, "query_patron_status", `{
+		"language": 1,
+		"transaction_date": "2018-04-16 15:07:01",
+		"institution_id": "0001",
+		"patron_id": "P001",
+		"terminal_password": "terminal password",
+		"patron_password": "1234"
+	}`)
+	if resp.Data.Code != 200 {
+		t.Fatalf("unexpected response: %+v", resp.Data)
+	}
+	item := resp.Data.Item.(map[string]interface{})
+	if item["personal_name"] != "Alice Reader" || item["valid_patron"] != true {
+		t.Fatalf("unexpected patron status: %v", item)
+	}
+	resp = postMethod(t, server, "check_out", `{"patron_id": "P001", "item_id": "I002"}`)
+	if resp.Data.Code != 200 || resp.Data.Item.(map[string]interface{})["ok"] != true {
+		t.Fatalf("unexpected checkout response: %+v", resp.Data)
+	}
+	resp = postMethod(t, server, "no_such_method", `{}`)
+	if resp.Data.Code == 200 {
+		t.Fatal("unknown method accepted")
+	}
 }
 
-func NewJSONResponse(version, msg string, code int) *JSONResponse {
-	return &JSONResponse{
-		Header: ResponseHeader{Version: version},
-		Data: ResponseData{
-			Msg:  msg,
-			Code: code,
-		},
+func TestHandler(t *testing.T) {
+	acs := startMockACS(t)
+	pool := newMockPool(t, acs)
+	var seen int
+	var handler http.Handler = sip2.NewHandler(pool, sip2.WithErrorFunc(func(w http.ResponseWriter, msg string, code int) {
+		http.Error(w, msg, code)
+	}))
+	mux := http.NewServeMux()
+	mux.Handle("/sip/", http.StripPrefix("/sip", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen++
+		handler.ServeHTTP(w, r)
+	})))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	server.URL += "/sip/"
+	resp := postMethod(t, server, "query_patron_status", `{"patron_id": "P001", "patron_password": "1234"}`)
+	if resp.Data.Code != 200 || seen != 1 {
+		t.Fatalf("unexpected response: %+v", resp.Data)
+	}
+	httpResp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(`{"header": {"method": "no_such_method"}, "data": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != 404 || httpResp.Header.Get(sip2.ErrorCodeHeader) != "unknown_method" {
+		t.Fatalf("custom error func not used: %d %q", httpResp.StatusCode, httpResp.Header.Get(sip2.ErrorCodeHeader))
 	}
 }
 
-func ErrorResponse(w http.ResponseWriter, msg string, code int) {
-	errResp := NewJSONResponse("2.0", msg, code)
-	jsonResp, _ := json.Marshal(errResp)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonResp)
+func TestErrorResponse(t *testing.T) {
+	server := httptest.NewServer(sip2.NewHandler(newMockPool(t, startMockACS(t)), sip2.WithErrorFunc(sip2.ErrorResponse)))
+	defer server.Close()
+	httpResp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(`{"header": {"method": "no_such_method"}, "data": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	resp := &sip2.JSONResponse{}
+	if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if httpResp.StatusCode != 404 || resp.Data.Code != 404 || resp.Data.ErrorCode != "unknown_method" {
+		t.Fatalf("want a 404 with error_code unknown_method, got %d %+v", httpResp.StatusCode, resp.Data)
+	}
 }
 
-func SuccessResponse(w http.ResponseWriter, sipResp interface{}) {
-	resp := NewJSONResponse("2.0", "ok", 200)
-	resp.Data.Item = sipResp
-	jsonResp, err := json.Marshal(resp)
+func TestProfiles(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	var transcript bytes.Buffer
+	pool.SetRecorder(sip2.NewRecorder(&transcript))
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithProfiles([]sip2.Profile{
+		{Name: "kiosk", APIKey: "kiosk-key", InstitutionID: "lib", TerminalPassword: "secret", Defaults: map[string]string{"language": "1"}},
+	})))
+	defer server.Close()
+	tests := []struct {
+		name   string
+		key    string
+		data   string
+		status int
+	}{
+		{"injected", "kiosk-key", `{"patron_id": "P001", "patron_password": "1234"}`, 200},
+		{"same value", "kiosk-key", `{"patron_id": "P001", "institution_id": "lib"}`, 200},
+		{"override", "kiosk-key", `{"patron_id": "P001", "institution_id": "other"}`, 403},
+		{"no key", "", `{"patron_id": "P001"}`, 401},
+		{"wrong key", "other-key", `{"patron_id": "P001"}`, 401},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"header": {"method": "query_patron_status"}, "data": %s}`, test.data)
+			req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+			if test.key != "" {
+				req.Header.Set(sip2.APIKeyHeader, test.key)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("want %d, got %d", test.status, resp.StatusCode)
+			}
+		})
+	}
+	if !bytes.Contains(transcript.Bytes(), []byte("AOlib|")) {
+		t.Errorf("institution id not injected: %s", transcript.String())
+	}
+}
+
+func TestProfilesSigned(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	var transcript bytes.Buffer
+	pool.SetRecorder(sip2.NewRecorder(&transcript))
+	server := httptest.NewServer(sip2.NewHandler(pool,
+		sip2.WithAuthenticator(sip2.NewKeyAuthenticator([]sip2.APIKey{{ID: "desk", Key: "desk-secret", HMAC: true}})),
+		sip2.WithProfiles([]sip2.Profile{{Name: "desk profile", KeyID: "desk", InstitutionID: "signed-lib"}}),
+	))
+	defer server.Close()
+	body := `{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/", bytes.NewBufferString(body))
+	sip2.SignRequest(req, "desk", "desk-secret", []byte(body))
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		ErrorResponse(w, "internal error", 500)
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("signed request matched no profile: %d", resp.StatusCode)
+	}
+	if !bytes.Contains(transcript.Bytes(), []byte("AOsigned-lib|")) {
+		t.Errorf("institution id not injected: %s", transcript.String())
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonResp)
 }
 
-func TestServer(t *testing.T) {
-	sipServer, err := NewSIPServer("./config.json", SuccessResponse, ErrorResponse)
+func TestAuth(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithAuthenticator(sip2.NewKeyAuthenticator([]sip2.APIKey{
+		{ID: "reader", Key: "reader-key", Methods: []string{"query_patron_status"}},
+		{ID: "desk", Key: "desk-secret", HMAC: true, InstitutionIDs: []string{"lib"}},
+		{ID: "bound", Key: "bound-key", ClientCertCN: "desk-1"},
+		{ID: "open", Key: "open-key"},
+	}))))
+	defer server.Close()
+	send := func(body string, prepare func(*http.Request, []byte)) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/", bytes.NewBufferString(body))
+		prepare(req, []byte(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	apiKey := func(key string) func(*http.Request, []byte) {
+		return func(r *http.Request, _ []byte) { r.Header.Set(sip2.APIKeyHeader, key) }
+	}
+	sign := func(secret string) func(*http.Request, []byte) {
+		return func(r *http.Request, body []byte) { sip2.SignRequest(r, "desk", secret, body) }
+	}
+	status := `{"header": {"method": "query_patron_status"}, "data": {"institution_id": "lib", "patron_id": "P001"}}`
+	checkout := `{"header": {"method": "check_out"}, "data": {"institution_id": "lib", "patron_id": "P001", "item_id": "I001"}}`
+	tests := []struct {
+		name    string
+		body    string
+		prepare func(*http.Request, []byte)
+		status  int
+	}{
+		{"no credentials", status, func(*http.Request, []byte) {}, 401},
+		{"api key", status, apiKey("reader-key"), 200},
+		{"wrong api key", status, apiKey("other-key"), 401},
+		{"method out of scope", checkout, apiKey("reader-key"), 403},
+		{"hmac key as api key", status, apiKey("desk-secret"), 401},
+		{"key without its certificate", status, apiKey("bound-key"), 403},
+		{"signed", status, sign("desk-secret"), 200},
+		{"wrong secret", status, sign("other-secret"), 401},
+		{"institution out of scope", strings.Replace(status, `"lib"`, `"other"`, 1), sign("desk-secret"), 403},
+		{"no institution", `{"header": {"method": "query_sc_status"}, "data": {}}`, sign("desk-secret"), 403},
+		{"login not allowed", `{"header": {"method": "login"}, "data": {"login_user_id": "u", "login_password": "p"}}`, apiKey("open-key"), 403},
+		{"stale timestamp", status, func(r *http.Request, body []byte) {
+			sip2.SignRequest(r, "desk", "desk-secret", body)
+			r.Header.Set(sip2.TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+		}, 401},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := send(test.body, test.prepare); got != test.status {
+				t.Fatalf("want %d, got %d", test.status, got)
+			}
+		})
+	}
+	// a nonce is accepted once, identical requests signed in the same second are not replays
+	status = strings.Replace(status, "P001", "P002", 1)
+	for i := 0; i < 2; i++ {
+		if got := send(status, sign("desk-secret")); got != 200 {
+			t.Fatalf("identical signed request %d refused: %d", i, got)
+		}
+	}
+	if got := send(status, func(r *http.Request, body []byte) {
+		sip2.SignRequest(r, "desk", "desk-secret", body)
+		r.Header.Del(sip2.NonceHeader)
+	}); got != 401 {
+		t.Fatalf("request without nonce accepted: %d", got)
+	}
+	var replayed *http.Request
+	if got := send(status, func(r *http.Request, body []byte) {
+		sip2.SignRequest(r, "desk", "desk-secret", body)
+		replayed = r
+	}); got != 200 {
+		t.Fatalf("signed request refused: %d", got)
+	}
+	if got := send(status, func(r *http.Request, _ []byte) { r.Header = replayed.Header }); got != 401 {
+		t.Fatalf("replayed request accepted: %d", got)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := writeTestCerts(t)
+	pool := newMockPool(t, startMockACS(t))
+	server := httptest.NewUnstartedServer(sip2.NewHandler(pool, sip2.WithAuthenticator(sip2.NewKeyAuthenticator([]sip2.APIKey{
+		{ClientCertCN: "desk-1", Methods: []string{"query_patron_status"}},
+	}))))
+	cfg := &sip2.ServerTLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		ClientAuth:   "optional",
+	}
+	tlsConfig, err := cfg.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	caPEM, _ := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`
+	for _, test := range []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+	}{
+		{"client certificate", []tls.Certificate{clientCert}, 200},
+		{"no certificate", nil, 401},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: test.certs}}}
+			resp, err := client.Post(server.URL, "application/json", bytes.NewBufferString(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("want %d, got %d", test.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	pool := newMockPool(t, startMockACS(t))
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithRateLimits(sip2.RateLimitConfig{
+		PerPatron:   sip2.RateBudget{Read: sip2.RateLimit{Rate: 0.01, Burst: 2}},
+		PerTerminal: sip2.RateBudget{Write: sip2.RateLimit{Rate: 0.01, Burst: 1}},
+	})))
+	defer server.Close()
+	post := func(method, data string) *http.Response {
+		body := fmt.Sprintf(`{"header": {"method": %q}, "data": %s}`, method, data)
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := post("query_patron_status", `{"patron_id": "P001"}`); resp.StatusCode != 200 {
+			t.Fatalf("request %d refused: %d", i, resp.StatusCode)
+		}
+	}
+	resp := post("query_patron_status", `{"patron_id": "P001"}`)
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("want 429 with Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp = post("query_patron_status", `{"patron_id": "P002"}`); resp.StatusCode != 200 {
+		t.Fatalf("another patron limited: %d", resp.StatusCode)
+	}
+	// the write budget of the terminal is apart from the read ones
+	if resp = post("check_in", `{"item_id": "I002"}`); resp.StatusCode == 429 {
+		t.Fatal("first write limited")
+	}
+	if resp = post("check_in", `{"item_id": "I002"}`); resp.StatusCode != 429 {
+		t.Fatalf("want the second write limited, got %d", resp.StatusCode)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	server := httptest.NewServer(sip2.NewHandler(newMockPool(t, startMockACS(t))))
+	defer server.Close()
+	entries := `[
+		{"method": "query_patron_status", "data": {"patron_id": "P001"}},
+		{"method": "check_out", "data": {"patron_id": "P003", "item_id": "I001"}},
+		{"method": "query_patron_status", "data": {"patron_id": ""}},
+		{"method": "query_item_information", "data": {"item_id": "I001"}}
+	]`
+	tests := []struct {
+		name   string
+		header string
+		codes  []int
+	}{
+		{"sequential", `{}`, []int{200, 422, 400, 200}},
+		{"parallel", `{"parallel": true}`, []int{200, 422, 400, 200}},
+		{"stop on error", `{"stop_on_error": true}`, []int{200, 422, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"header": %s, "entries": %s}`, test.header, entries)
+			resp, err := http.Post(server.URL+"/batch", "application/json", bytes.NewBufferString(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var jsonResp struct {
+				Data struct {
+					ItemList []sip2.BatchResult `json:"item_list"`
+				} `json:"data"`
+			}
+			if err = json.NewDecoder(resp.Body).Decode(&jsonResp); err != nil {
+				t.Fatal(err)
+			}
+			results := jsonResp.Data.ItemList
+			if resp.StatusCode != 200 || len(results) != len(test.codes) {
+				t.Fatalf("unexpected response: %d %+v", resp.StatusCode, results)
+			}
+			for i, code := range test.codes {
+				if results[i].Code != code {
+					t.Errorf("entry %d: want %d, got %+v", i, code, results[i])
+				}
+				if code == 0 && results[i].ErrorCode != "skipped" {
+					t.Errorf("entry %d not skipped: %+v", i, results[i])
+				}
+			}
+		})
+	}
+	body := fmt.Sprintf(`{"header": {"parallel": true, "stop_on_error": true}, "entries": %s}`, entries)
+	resp, err := http.Post(server.URL+"/batch", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("want 400 for stop_on_error with parallel, got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimitsPerKey(t *testing.T) {
+	limits := sip2.WithRateLimits(sip2.RateLimitConfig{PerKey: sip2.RateBudget{Read: sip2.RateLimit{Rate: 0.01, Burst: 1}}})
+	post := func(server *httptest.Server, key string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(`{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`))
+		req.Header.Set(sip2.APIKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// without an authenticator the header is not a key, the per key budget does not apply
+	open := httptest.NewServer(sip2.NewHandler(newMockPool(t, startMockACS(t)), limits))
+	defer open.Close()
+	for i := 0; i < 2; i++ {
+		if got := post(open, "same-header"); got != 200 {
+			t.Fatalf("unauthenticated request %d limited: %d", i, got)
+		}
+	}
+	auth := sip2.WithAuthenticator(sip2.NewKeyAuthenticator([]sip2.APIKey{{ID: "kiosk", Key: "kiosk-key"}}))
+	server := httptest.NewServer(sip2.NewHandler(newMockPool(t, startMockACS(t)), limits, auth))
+	defer server.Close()
+	if got := post(server, "kiosk-key"); got != 200 {
+		t.Fatalf("first request refused: %d", got)
+	}
+	if got := post(server, "kiosk-key"); got != 429 {
+		t.Fatalf("want 429 over the key budget, got %d", got)
+	}
+}
+
+func TestBatchRateLimited(t *testing.T) {
+	server := httptest.NewServer(sip2.NewHandler(newMockPool(t, startMockACS(t)), sip2.WithRateLimits(sip2.RateLimitConfig{
+		PerPatron: sip2.RateBudget{Read: sip2.RateLimit{Rate: 0.01, Burst: 1}},
+	})))
+	defer server.Close()
+	body := `{"header": {}, "entries": [
+		{"method": "query_patron_status", "data": {"patron_id": "P001"}},
+		{"method": "query_patron_status", "data": {"patron_id": "P001"}}
+	]}`
+	resp, err := http.Post(server.URL+"/batch", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var jsonResp struct {
+		Data struct {
+			ItemList []sip2.BatchResult `json:"item_list"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&jsonResp); err != nil {
+		t.Fatal(err)
+	}
+	results := jsonResp.Data.ItemList
+	if len(results) != 2 || results[0].Code != 200 || results[1].Code != 429 || results[1].RetryAfter <= 0 {
+		t.Fatalf("want the second entry limited with retry_after, got %+v", results)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	pool, proxy := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Pass, Latency: 300 * time.Millisecond})
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithIdempotency(sip2.NewMemoryIdempotencyStore(), time.Minute)))
+	defer server.Close()
+	send := func(key, data string) (*http.Response, string) {
+		body := fmt.Sprintf(`{"header": {"method": "check_out"}, "data": %s}`, data)
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+		req.Header.Set(sip2.IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	checkout := `{"patron_id": "P001", "item_id": "I002"}`
+	bodies := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, body := send("k1", checkout)
+			bodies <- body
+		}()
+	}
+	first, second := <-bodies, <-bodies
+	if first != second {
+		t.Fatalf("concurrent repeats answered differently:\n%s\n%s", first, second)
+	}
+	resp, body := send("k1", checkout)
+	if body != first || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("repeat not replayed: %s", body)
+	}
+	if resp, _ = send("k1", `{"patron_id": "P001", "item_id": "I003"}`); resp.StatusCode != 409 {
+		t.Fatalf("want 409 for a reused key, got %d", resp.StatusCode)
+	}
+	checkouts := 0
+	for _, frame := range proxy.Frames() {
+		if strings.HasPrefix(frame, "11") {
+			checkouts++
+		}
+	}
+	if checkouts != 1 {
+		t.Fatalf("want one checkout sent, got %d", checkouts)
+	}
+}
+
+func TestIdempotencyNotKept(t *testing.T) {
+	pool, proxy := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Drop}, sip2test.FaultStep{Fault: sip2test.Drop}, sip2test.FaultStep{Fault: sip2test.Drop})
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithIdempotency(sip2.NewMemoryIdempotencyStore(), 0)))
+	defer server.Close()
+	send := func(body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+		req.Header.Set(sip2.IdempotencyKeyHeader, "k1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	checkout := `{"header": {"method": "check_out"}, "data": {"patron_id": "P001", "item_id": "I002"}}`
+	if resp := send(checkout); resp.StatusCode < 500 {
+		t.Fatalf("want a 5xx with the ACS down, got %d", resp.StatusCode)
+	}
+	// a transient failure is not kept, the retry reaches the ACS
+	resp := send(checkout)
+	if resp.StatusCode != 200 || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry after a transient failure not sent: %d %q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if len(proxy.Frames()) == 0 {
+		t.Fatal("retry not sent to the ACS")
+	}
+	// a zero window keeps the responses for the default window
+	if resp = send(checkout); resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("response not kept with a zero window")
+	}
+	large := `{"header": {"method": "check_out"}, "data": {"patron_id": "` + strings.Repeat("x", 1<<20) + `"}}`
+	if resp = send(large); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want 413 for a body over 1MB, got %d", resp.StatusCode)
+	}
+}
+
+func TestFileIdempotencyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.jsonl")
+	store, err := sip2.NewFileIdempotencyStore(path)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	err = sipServer.ListenAndServe()
+	store.Put("live", &sip2.StoredResponse{Status: 201, Body: []byte("{}"), Expires: time.Now().Add(time.Hour)})
+	store.Put("expired", &sip2.StoredResponse{Status: 200, Expires: time.Now().Add(-time.Second)})
+	// the expired responses are pruned from the file while the store runs
+	for i := 0; i < 200; i++ {
+		store.Put(fmt.Sprintf("expired-%d", i), &sip2.StoredResponse{Status: 200, Expires: time.Now().Add(-time.Second)})
+	}
+	if b, _ := ioutil.ReadFile(path); bytes.Count(b, []byte("\n")) > 101 {
+		t.Fatalf("file not compacted: %d lines", bytes.Count(b, []byte("\n")))
+	}
+	store.Close()
+	store, err = sip2.NewFileIdempotencyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if resp, _ := store.Get("live"); resp == nil || resp.Status != 201 {
+		t.Fatalf("response not loaded back: %+v", resp)
+	}
+	if resp, _ := store.Get("expired"); resp != nil {
+		t.Fatalf("expired response loaded back: %+v", resp)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	pool, proxy := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Drop}, sip2test.FaultStep{Fault: sip2test.Drop}, sip2test.FaultStep{Fault: sip2test.Drop})
+	dir := t.TempDir()
+	journalPath, reportPath := filepath.Join(dir, "journal.jsonl"), filepath.Join(dir, "conflicts.jsonl")
+	journal, err := sip2.NewOfflineJournal(journalPath, reportPath, 14*24*time.Hour)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	journal.TerminalPassword = "replay-secret"
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithOffline(journal, time.Hour)))
+	defer server.Close()
+	resp := postMethod(t, server, "check_out", `{"patron_id": "P001", "item_id": "I002", "transaction_date": "2020-01-02 10:00:00", "terminal_password": "client-secret", "patron_password": "1234"}`)
+	item, _ := resp.Data.Item.(map[string]interface{})
+	if resp.Data.Code != 200 || item["ok"] != true || item["due_date"] != "2020-01-16 10:00:00" {
+		t.Fatalf("unexpected offline checkout: %+v", resp.Data)
+	}
+	// journaled behind the first one although the ACS is back
+	resp = postMethod(t, server, "check_out", `{"patron_id": "P001", "item_id": "I999"}`)
+	if resp.Data.Code != 200 || journal.Pending() != 2 {
+		t.Fatalf("checkout not journaled: %+v, %d pending", resp.Data, journal.Pending())
+	}
+	reloaded, err := sip2.NewOfflineJournal(journalPath, reportPath, 14*24*time.Hour)
+	if err != nil || reloaded.Pending() != 2 {
+		t.Fatalf("journal not durable: %v, %d pending", err, reloaded.Pending())
+	}
+	if b, _ := ioutil.ReadFile(journalPath); bytes.Contains(b, []byte("client-secret")) || bytes.Contains(b, []byte("1234")) {
+		t.Fatalf("passwords journaled: %s", b)
+	}
+	// a replay failing on a protocol error keeps the entry
+	proxy.Inject(sip2test.FaultStep{Fault: sip2test.CorruptChecksum}, sip2test.FaultStep{Fault: sip2test.CorruptChecksum}, sip2test.FaultStep{Fault: sip2test.CorruptChecksum})
+	if err = journal.Replay(pool); !errors.Is(err, sip2.ErrProtocol) || journal.Pending() != 2 {
+		t.Fatalf("want the entries kept on a protocol error, got %v, %d pending", err, journal.Pending())
+	}
+	sent := len(proxy.Frames())
+	if err = journal.Replay(pool); err != nil {
+		t.Fatal(err)
+	}
+	if journal.Pending() != 0 {
+		t.Fatalf("%d entries left after replay", journal.Pending())
+	}
+	var replayed []string
+	for _, frame := range proxy.Frames()[sent:] {
+		if strings.HasPrefix(frame, "11") {
+			replayed = append(replayed, frame)
+		}
+	}
+	if len(replayed) != 2 || replayed[0][3] != 'Y' || !strings.Contains(replayed[0], "20200102    100000") || !strings.Contains(replayed[0], "|ACreplay-secret|") {
+		t.Fatalf("unexpected replay: %q", replayed)
+	}
+	conflicts, err := journal.Conflicts()
+	if err != nil || len(conflicts) != 1 || !strings.Contains(string(conflicts[0].Entry.Request), "I999") {
+		t.Fatalf("unexpected conflicts: %v %+v", err, conflicts)
+	}
+	resp = postMethod(t, server, "query_sc_status", `{}`)
+	if item, _ = resp.Data.Item.(map[string]interface{}); item["offline_ok"] != true {
+		t.Fatalf("offline_ok not reported: %+v", resp.Data)
+	}
+	// the ACS may have applied a checkout it did not answer, it is not journaled
+	proxy.Inject(sip2test.FaultStep{Fault: sip2test.Stall}, sip2test.FaultStep{Fault: sip2test.Stall}, sip2test.FaultStep{Fault: sip2test.Stall})
+	resp = postMethod(t, server, "check_out", `{"patron_id": "P001", "item_id": "I003"}`)
+	if resp.Data.Code != http.StatusGatewayTimeout || journal.Pending() != 0 {
+		t.Fatalf("timed out checkout journaled: %+v, %d pending", resp.Data, journal.Pending())
+	}
+}
+
+func TestAudit(t *testing.T) {
+	acs := startMockACS(t)
+	pool := newMockPool(t, acs)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := sip2.NewAuditLog(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithAudit(auditLog)))
+	defer server.Close()
+	postMethod(t, server, "query_patron_status", `{"patron_id": "P001", "patron_password": "1234"}`)
+	postMethod(t, server, "check_out", `{"patron_id": "P001", "item_id": "I002"}`)
+	postMethod(t, server, "check_out", `{"patron_id": "P002", "item_id": "I999"}`)
+	// the exchanges made for no client are audited by the pool
+	if err = pool.Login("kiosk1", "kiosk password", ""); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Close()
+	if rotated, _ := filepath.Glob(path + ".*"); len(rotated) == 0 {
+		t.Fatal("audit log not rotated")
+	}
+	records, err := sip2.QueryAudit(path, sip2.AuditFilter{PatronID: "P001"})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("unexpected records: %v %+v", err, records)
+	}
+	if records[0].Method != "query_patron_status" || records[0].Client != "127.0.0.1" || records[0].Request["patron_password"] != "[redacted]" {
+		t.Fatalf("unexpected record: %+v", records[0])
+	}
+	records, err = sip2.QueryAudit(path, sip2.AuditFilter{ItemID: "I999"})
+	if err != nil || len(records) != 1 || records[0].Outcome != "rejected" {
+		t.Fatalf("unexpected records: %v %+v", err, records)
+	}
+	records, _ = sip2.QueryAudit(path, sip2.AuditFilter{})
+	logins := 0
+	for _, record := range records {
+		if record.Method == "login" && record.Client == "gateway" && record.Outcome == "ok" && record.Request["login_password"] == "[redacted]" {
+			logins++
+		}
+	}
+	if logins != 2 {
+		t.Fatalf("want the logins of both connections audited, got %d in %+v", logins, records)
+	}
+	records, _ = sip2.QueryAudit(path, sip2.AuditFilter{From: time.Now().Add(time.Hour)})
+	if len(records) != 0 {
+		t.Fatalf("records after the date range: %+v", records)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	pool, _ := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.CorruptChecksum}, sip2test.FaultStep{Fault: sip2test.Drop})
+	server := httptest.NewServer(sip2.NewHandler(pool))
+	defer server.Close()
+	postMethod(t, server, "query_patron_status", `{"patron_id": "P001"}`)
+	postMethod(t, server, "query_sc_status", `{}`)
+	postMethod(t, server, "no_such_method", `{}`)
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	for _, line := range []string{
+		"sip2_pool_size 1",
+		"sip2_pool_in_use 0",
+		"sip2_checksum_failures_total 1",
+		"sip2_resends_total 1",
+		"sip2_reconnects_total 1",
+		"sip2_retries_total 2",
+		"sip2_acs_online 1",
+		`sip2_exchange_duration_seconds_count{command="PatronStatusRequest",outcome="ok"} 1`,
+		`sip2_http_request_duration_seconds_count{method="query_sc_status",code="200"} 1`,
+		`sip2_http_request_duration_seconds_count{method="unknown",code="404"} 1`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Fatalf("%q not in metrics:\n%s", line, b)
+		}
+	}
+}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	remote string
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (ts *testSpan) SetAttribute(key string, value interface{}) { ts.attrs[key] = value }
+func (ts *testSpan) RecordError(err error)                      { ts.err = err }
+func (ts *testSpan) End()                                       { ts.ended = true }
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpanKey struct{}
+
+func (tt *testTracer) Start(ctx context.Context, name string) (context.Context, sip2.Span) {
+	span := &testSpan{name: name, attrs: make(map[string]interface{})}
+	span.parent, _ = ctx.Value(testSpanKey{}).(*testSpan)
+	if tp, ok := sip2.TraceParentFromContext(ctx); ok && span.parent == nil {
+		span.remote = tp.SpanID
+	}
+	tt.mu.Lock()
+	tt.spans = append(tt.spans, span)
+	tt.mu.Unlock()
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func TestTracing(t *testing.T) {
+	pool, _ := newFaultPool(t, sip2test.FaultStep{Fault: sip2test.Pass}, sip2test.FaultStep{Fault: sip2test.Drop})
+	if err := pool.Login("kiosk1", "kiosk password", "hall"); err != nil {
+		t.Fatal(err)
+	}
+	tracer := &testTracer{}
+	server := httptest.NewServer(sip2.NewHandler(pool, sip2.WithTracer(tracer)))
+	defer server.Close()
+	body := `{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+	req.Header.Set(sip2.TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var names []string
+	for _, span := range tracer.spans {
+		if !span.ended {
+			t.Fatalf("span %s not ended", span.name)
+		}
+		path := span.name
+		for parent := span.parent; parent != nil; parent = parent.parent {
+			path = parent.name + "/" + path
+		}
+		names = append(names, path)
+	}
+	expected := []string{
+		"sip2.http",
+		"sip2.http/sip2.exchange",
+		"sip2.http/sip2.exchange/sip2.pool_wait",
+		"sip2.http/sip2.exchange/sip2.attempt",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.write",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.read",
+		"sip2.http/sip2.exchange/sip2.attempt",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.dial",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.login",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.write",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.read",
+		"sip2.http/sip2.exchange/sip2.attempt/sip2.decode",
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected spans:\n%s", strings.Join(names, "\n"))
+	}
+	root := tracer.spans[0]
+	if root.remote != "00f067aa0ba902b7" || root.attrs["sip2.method"] != "query_patron_status" || root.attrs["http.status_code"] != 200 {
+		t.Fatalf("unexpected request span: %+v", root)
+	}
+	if tracer.spans[3].err == nil || tracer.spans[6].attrs["sip2.attempt"] != 2 {
+		t.Fatalf("retry not traced: %+v %+v", tracer.spans[3], tracer.spans[6])
+	}
+	if _, err = sip2.ParseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01"); err == nil {
+		t.Fatal("all zero trace id accepted")
+	}
+}
+
+func TestREST(t *testing.T) {
+	acs := startMockACS(t)
+	server := httptest.NewServer(sip2.NewHandler(newMockPool(t, acs)))
+	defer server.Close()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"patron", "GET", "/patrons/P001?patron_password=1234", "", 200},
+		{"unknown patron", "GET", "/patrons/P999", "", 404},
+		{"wrong password", "GET", "/patrons/P001/status?patron_password=0000", "", 403},
+		{"item", "GET", "/items/I001", "", 200},
+		{"unknown item", "GET", "/items/I999", "", 404},
+		{"checkout", "POST", "/checkouts", `{"patron_id": "P001", "item_id": "I002", "patron_password": "1234"}`, 201},
+		{"checkout refused", "POST", "/checkouts", `{"patron_id": "P003", "item_id": "I001"}`, 422},
+		{"checkin", "POST", "/checkins", `{"item_id": "I002"}`, 200},
+		{"payment", "POST", "/patrons/P002/fees/F001/payments", `{"fee_amount": 2.5, "fee_type": 1, "payment_type": 0}`, 201},
+		{"hold", "POST", "/holds", `{"patron_id": "P002", "item_id": "I003", "patron_password": "5678"}`, 201},
+		{"cancel hold", "DELETE", "/holds/I003?patron_id=P002&patron_password=5678", "", 200},
+		{"cancel missing hold", "DELETE", "/holds/I003?patron_id=P002&patron_password=5678", "", 422},
+		{"bad field", "GET", "/items/I001?no_such_field=1", "", 400},
+		{"method not allowed", "PUT", "/checkouts", "", 405},
+		{"no such resource", "GET", "/patrons/P001/loans", "", 404},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonResp := &sip2.JSONResponse{}
+		err = json.NewDecoder(resp.Body).Decode(jsonResp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if resp.StatusCode != test.status || jsonResp.Data.Code != test.status {
+			t.Errorf("%s: want %d, got %d (%s)", test.name, test.status, resp.StatusCode, jsonResp.Data.Msg)
+		}
+	}
+	if holds := acs.Holds("I003"); len(holds) != 0 {
+		t.Fatalf("hold not cancelled: %v", holds)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		fields map[string]string
+		field  string
+		reason string
+		frame  string
+	}{
+		{"valid", "hold", map[string]string{"patron_id": "P001", "hold_mode": "+", "hold_type": "2"}, "", "", "|BS|BY2|AO|"},
+		{"empty optional field", "hold", map[string]string{"patron_id": "P001", "hold_mode": "+"}, "", "", "|BS|AO|"},
+		{"hold_type 0", "hold", map[string]string{"patron_id": "P001", "hold_mode": "+", "hold_type": "0"}, "", "", "|BS|AO|"},
+		{"oneof", "hold", map[string]string{"patron_id": "P001", "hold_mode": "+", "hold_type": "5"}, "hold_type", "must be one of 1 2 3 4", ""},
+		{"oneof string", "hold", map[string]string{"patron_id": "P001", "hold_mode": "x"}, "hold_mode", "must be one of + - *", ""},
+		{"required", "hold", map[string]string{"hold_mode": "+"}, "patron_id", "required", ""},
+		{"variable length", "query_patron_status", map[string]string{"patron_id": strings.Repeat("P", 256)}, "patron_id", "longer than 255 characters", ""},
+		{"fixed length", "hold", map[string]string{"patron_id": "P001", "hold_mode": "+", "hold_type": "12"}, "hold_type", "at most 1 digit", ""},
+		{"framing", "query_patron_status", map[string]string{"patron_id": "P|001"}, "patron_id", "must not contain | or line breaks", ""},
+		{"date range", "check_in", map[string]string{"item_id": "I001", "return_date": "2100-01-01 00:00:00"}, "return_date", "date out of range", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := sip2.MethodMap[test.method]()
+			for name, value := range test.fields {
+				if err := sip2.SetField(req, name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := sip2.Validate(req)
+			if test.field == "" {
+				if err != nil {
+					t.Fatalf("want valid, got %s", err)
+				}
+				if b, _ := sip2.EncodeRequest(req); !strings.Contains(string(b), test.frame) {
+					t.Fatalf("want %s in the frame, got %s", test.frame, b)
+				}
+				return
+			}
+			var invalid *sip2.ValidationError
+			if !errors.As(err, &invalid) || invalid.Fields[test.field] != test.reason {
+				t.Fatalf("want %s: %s, got %v", test.field, test.reason, err)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []sip2test.FaultStep
+		down   bool
+		body   string
+		status int
+		code   string
+	}{
+		{name: "bad json", body: `{"header": `, status: 400, code: "validation_error"},
+		{name: "bad data", body: `{"header": {"method": "check_out"}, "data": {"patron_id": 1}}`, status: 400, code: "validation_error"},
+		{name: "invalid fields", body: `{"header": {"method": "check_out"}, "data": {"patron_id": "", "item_id": "I0|01", "transaction_date": "1900-01-01 00:00:00"}}`, status: 400, code: "validation_error"},
+		{name: "unknown method", body: `{"header": {"method": "no_such_method"}, "data": {}}`, status: 404, code: "unknown_method"},
+		{name: "too large", body: `{"header": {"method": "check_out"}, "data": {"patron_id": "` + strings.Repeat("x", 1<<20) + `"}}`, status: 413, code: "request_too_large"},
+		{name: "rejected", body: `{"header": {"method": "check_out"}, "data": {"patron_id": "P003", "item_id": "I001"}}`, status: 422, code: "rejected"},
+		{name: "acs down", down: true, body: `{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`, status: 503, code: "acs_unavailable"},
+		{name: "timeout", steps: []sip2test.FaultStep{{Fault: sip2test.Stall}, {Fault: sip2test.Stall}, {Fault: sip2test.Stall}}, body: `{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`, status: 504, code: "acs_timeout"},
+		{name: "protocol", steps: []sip2test.FaultStep{{Fault: sip2test.InvalidCommand}}, body: `{"header": {"method": "query_patron_status"}, "data": {"patron_id": "P001"}}`, status: 502, code: "protocol_error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool, proxy := newFaultPool(t, test.steps...)
+			if test.down {
+				proxy.Close()
+			}
+			server := httptest.NewServer(sip2.NewHandler(pool))
+			defer server.Close()
+			resp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			jsonResp := &sip2.JSONResponse{}
+			err = json.NewDecoder(resp.Body).Decode(jsonResp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.status || jsonResp.Data.Code != test.status || jsonResp.Data.ErrorCode != test.code {
+				t.Fatalf("want %d %s, got %d %+v", test.status, test.code, resp.StatusCode, jsonResp.Data)
+			}
+			if test.code == "rejected" && jsonResp.Data.Item == nil {
+				t.Fatal("rejected transaction without the ACS response")
+			}
+			if test.name == "invalid fields" {
+				fields, _ := jsonResp.Data.Item.(map[string]interface{})
+				for _, name := range []string{"patron_id", "item_id", "transaction_date"} {
+					if fields[name] == nil {
+						t.Errorf("want %s listed, got %v", name, jsonResp.Data.Item)
+					}
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,702 @@
+package sip2test
+
+import (
+	"context"
+	"net"
+	"sip2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockACS is an ACSHandler keeping patrons, items, loans, holds and fines in memory.
+// It applies the basic circulation rules (blocks, charge and fee limits, holds,
+// renewal limits) so the SIP2 client stack can be tested without a real ACS.
+type MockACS struct {
+	Now      func() time.Time
+	mu       sync.Mutex
+	fixtures *Fixtures
+	patrons  map[string]*Patron
+	items    map[string]*Item
+	loans    map[string]*Loan
+	holds    []*Hold
+	fines    []*Fine
+	server   *sip2.ACSServer
+	addr     *net.TCPAddr
+}
+
+func NewMockACS(fixtures *Fixtures) *MockACS {
+	m := &MockACS{
+		Now:      time.Now,
+		fixtures: fixtures,
+		patrons:  make(map[string]*Patron),
+		items:    make(map[string]*Item),
+		loans:    make(map[string]*Loan),
+	}
+	for i := range fixtures.Patrons {
+		patron := fixtures.Patrons[i]
+		m.patrons[patron.ID] = &patron
+	}
+	for i := range fixtures.Items {
+		item := fixtures.Items[i]
+		m.items[item.ID] = &item
+	}
+	for i := range fixtures.Loans {
+		loan := fixtures.Loans[i]
+		m.loans[loan.ItemID] = &loan
+	}
+	for i := range fixtures.Holds {
+		hold := fixtures.Holds[i]
+		m.holds = append(m.holds, &hold)
+	}
+	for i := range fixtures.Fines {
+		fine := fixtures.Fines[i]
+		m.fines = append(m.fines, &fine)
+	}
+	return m
+}
+
+// StartMockACS serves a MockACS on a loopback port.
+func StartMockACS(fixtures *Fixtures) (*MockACS, error) {
+	m := NewMockACS(fixtures)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	m.addr = l.Addr().(*net.TCPAddr)
+	m.server = sip2.NewACSServer(m.addr.IP.String(), m.addr.Port, m, 0, false, true)
+	go m.server.Serve(l)
+	return m, nil
+}
+
+func (m *MockACS) Host() string {
+	return m.addr.IP.String()
+}
+
+func (m *MockACS) Port() int {
+	return m.addr.Port
+}
+
+func (m *MockACS) NewClientPool(poolSize int) (*sip2.ClientPool, error) {
+	return sip2.NewClientPool(m.Host(), m.Port(), poolSize, 5, 3, true)
+}
+
+func (m *MockACS) Close() error {
+	if m.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.server.Shutdown(ctx)
+}
+
+func (m *MockACS) Patron(id string) (Patron, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	patron, ok := m.patrons[id]
+	if !ok {
+		return Patron{}, false
+	}
+	return *patron, true
+}
+
+func (m *MockACS) Loan(itemID string) (Loan, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	loan, ok := m.loans[itemID]
+	if !ok {
+		return Loan{}, false
+	}
+	return *loan, true
+}
+
+func (m *MockACS) Holds(itemID string) []Hold {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	holds := make([]Hold, 0, len(m.holds))
+	for _, hold := range m.itemHolds(itemID) {
+		holds = append(holds, *hold)
+	}
+	return holds
+}
+
+func (m *MockACS) Fees(patronID string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.patronFees(patronID)
+}
+
+func (m *MockACS) patronLoans(patronID string) []*Loan {
+	loans := make([]*Loan, 0, 8)
+	for _, loan := range m.loans {
+		if loan.PatronID == patronID {
+			loans = append(loans, loan)
+		}
+	}
+	return loans
+}
+
+func (m *MockACS) overdueLoans(patronID string) []*Loan {
+	loans := make([]*Loan, 0, 8)
+	for _, loan := range m.patronLoans(patronID) {
+		if parseDate(loan.DueDate).Before(m.Now()) {
+			loans = append(loans, loan)
+		}
+	}
+	return loans
+}
+
+func (m *MockACS) itemHolds(itemID string) []*Hold {
+	holds := make([]*Hold, 0, 4)
+	for _, hold := range m.holds {
+		if hold.ItemID == itemID {
+			holds = append(holds, hold)
+		}
+	}
+	return holds
+}
+
+func (m *MockACS) patronHolds(patronID string) []*Hold {
+	holds := make([]*Hold, 0, 4)
+	for _, hold := range m.holds {
+		if hold.PatronID == patronID {
+			holds = append(holds, hold)
+		}
+	}
+	return holds
+}
+
+func (m *MockACS) removeHold(patronID, itemID string) {
+	for i, hold := range m.holds {
+		if hold.PatronID == patronID && hold.ItemID == itemID {
+			m.holds = append(m.holds[:i], m.holds[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *MockACS) heldForOther(patronID, itemID string) bool {
+	holds := m.itemHolds(itemID)
+	return len(holds) > 0 && holds[0].PatronID != patronID
+}
+
+func (m *MockACS) patronFees(patronID string) float64 {
+	var total float64
+	for _, fine := range m.fines {
+		if fine.PatronID == patronID {
+			total += fine.Amount
+		}
+	}
+	return total
+}
+
+func (m *MockACS) patronStatus(patron *Patron) string {
+	status := []byte(strings.Repeat(" ", 14))
+	if patron.Blocked {
+		copy(status, "YYYY")
+	}
+	if patron.ChargeLimit > 0 && len(m.patronLoans(patron.ID)) >= patron.ChargeLimit {
+		status[5] = 'Y'
+	}
+	if len(m.overdueLoans(patron.ID)) > 0 {
+		status[6] = 'Y'
+	}
+	if patron.FeeLimit > 0 && m.patronFees(patron.ID) > patron.FeeLimit {
+		status[10] = 'Y'
+	}
+	return string(status)
+}
+
+// checkPatron returns the patron and whether the password is valid, an empty password
+// is accepted since SCs are allowed to omit it.
+func (m *MockACS) checkPatron(id string, password *sip2.StrValue) (*Patron, bool) {
+	patron, ok := m.patrons[id]
+	if !ok {
+		return nil, false
+	}
+	return patron, *password == "" || string(*password) == patron.Password
+}
+
+func (m *MockACS) dueDate() time.Time {
+	loanDays := m.fixtures.LoanDays
+	if loanDays == 0 {
+		loanDays = 14
+	}
+	return m.Now().AddDate(0, 0, loanDays)
+}
+
+func (m *MockACS) Login(ctx context.Context, req *sip2.LoginRequest) (*sip2.LoginResponse, error) {
+	resp := sip2.NewLoginResponse()
+	password, ok := m.fixtures.Logins[string(*req.LoginUserID.StrValue)]
+	*resp.OK.BoolValue = sip2.BoolValue(len(m.fixtures.Logins) == 0 || (ok && password == string(*req.LoginPassword.StrValue)))
+	return resp, nil
+}
+
+func (m *MockACS) SCStatus(ctx context.Context, req *sip2.SCStatusRequest) (*sip2.ACSStatusResponse, error) {
+	resp := sip2.NewACSStatusResponse()
+	*resp.OnlineStatus.BoolValue = true
+	*resp.CheckinOK.BoolValue = true
+	*resp.CheckoutOK.BoolValue = true
+	*resp.ACSRenewalPolicy.BoolValue = true
+	*resp.StatusUpdateOK.BoolValue = true
+	*resp.TimeoutPeriod.IntValue = 30
+	*resp.RetriesAllowed.IntValue = 3
+	*resp.DateTimeSync.TimeValue = sip2.TimeValue(m.Now())
+	*resp.ProtocolVersion.StrValue = "2.00"
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.LibraryName.StrValue = sip2.StrValue(m.fixtures.LibraryName)
+	*resp.SupportedMessages.StrValue = "YYYYYYYYYYYYYYYY"
+	return resp, nil
+}
+
+func (m *MockACS) PatronStatus(ctx context.Context, req *sip2.PatronStatusRequest) (*sip2.PatronStatusResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewPatronStatusResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	if patron == nil {
+		*resp.PatronStatus.StrValue = "YYYY          "
+		*resp.ScreenMessage.StrValue = "unknown patron"
+		return resp, nil
+	}
+	*resp.PatronStatus.StrValue = sip2.StrValue(m.patronStatus(patron))
+	*resp.PersonalName.StrValue = sip2.StrValue(patron.Name)
+	*resp.ValidPatron.BoolValue = true
+	*resp.ValidPatronPassword.BoolValue = sip2.BoolValue(validPassword)
+	return resp, nil
+}
+
+func (m *MockACS) PatronInformation(ctx context.Context, req *sip2.PatronInformationRequest) (*sip2.PatronInformationResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewPatronInformationResponse()
+	*resp.Language.IntValue = *req.Language.IntValue
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	if patron == nil {
+		*resp.PatronStatus.StrValue = "YYYY          "
+		*resp.ScreenMessage.StrValue = "unknown patron"
+		return resp, nil
+	}
+	holds := m.patronHolds(patron.ID)
+	holdItems := make([]string, 0, len(holds))
+	var unavailable int
+	for _, hold := range holds {
+		holdItems = append(holdItems, hold.ItemID)
+		if _, onLoan := m.loans[hold.ItemID]; onLoan {
+			unavailable++
+		}
+	}
+	var fineItems int
+	for _, fine := range m.fines {
+		if fine.PatronID == patron.ID && fine.Amount > 0 {
+			fineItems++
+		}
+	}
+	*resp.PatronStatus.StrValue = sip2.StrValue(m.patronStatus(patron))
+	*resp.HoldItemsCount.IntValue = sip2.IntValue(len(holds))
+	*resp.OverdueItemsCount.IntValue = sip2.IntValue(len(m.overdueLoans(patron.ID)))
+	*resp.ChargedItemsCount.IntValue = sip2.IntValue(len(m.patronLoans(patron.ID)))
+	*resp.FineItemsCount.IntValue = sip2.IntValue(fineItems)
+	*resp.UnavailableHoldsCount.IntValue = sip2.IntValue(unavailable)
+	*resp.PersonalName.StrValue = sip2.StrValue(patron.Name)
+	*resp.ChargedItemsLimit.IntValue = sip2.IntValue(patron.ChargeLimit)
+	*resp.ValidPatron.BoolValue = true
+	*resp.ValidPatronPassword.BoolValue = sip2.BoolValue(validPassword)
+	*resp.CurrencyType.StrValue = "USD"
+	*resp.FeeAmount.FloatValue = sip2.FloatValue(m.patronFees(patron.ID))
+	*resp.FeeLimit.IntValue = sip2.IntValue(patron.FeeLimit)
+	*resp.HoldItems.StrSliceValue = holdItems
+	*resp.EmailAddress.StrValue = sip2.StrValue(patron.Email)
+	*resp.HomeAddress.StrValue = sip2.StrValue(patron.Address)
+	return resp, nil
+}
+
+func (m *MockACS) ItemInformation(ctx context.Context, req *sip2.ItemInformationRequest) (*sip2.ItemInformationResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewItemInformationResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.ItemID.StrValue = *req.ItemID.StrValue
+	item, ok := m.items[string(*req.ItemID.StrValue)]
+	if !ok {
+		*resp.CirculationStatus.IntValue = 1
+		*resp.ScreenMessage.StrValue = "unknown item"
+		return resp, nil
+	}
+	holds := m.itemHolds(item.ID)
+	*resp.CirculationStatus.IntValue = 3
+	if loan, onLoan := m.loans[item.ID]; onLoan {
+		*resp.CirculationStatus.IntValue = 4
+		*resp.DueDate.TimeValue = sip2.TimeValue(parseDate(loan.DueDate))
+	} else if len(holds) > 0 {
+		*resp.CirculationStatus.IntValue = 8
+	}
+	*resp.SecurityMarker.IntValue = 2
+	*resp.FeeType.IntValue = 1
+	*resp.HoldQueueLength.FloatValue = sip2.FloatValue(len(holds))
+	*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+	*resp.Author.StrValue = sip2.StrValue(item.Author)
+	*resp.ISBN.StrValue = sip2.StrValue(item.ISBN)
+	*resp.Owner.StrValue = sip2.StrValue(item.Owner)
+	*resp.MediaType.IntValue = sip2.IntValue(item.MediaType)
+	*resp.PermanentLocation.StrValue = sip2.StrValue(item.Location)
+	*resp.CurrentLocation.StrValue = sip2.StrValue(item.Location)
+	*resp.ItemProperties.StrSliceValue = item.Properties
+	return resp, nil
+}
+
+func (m *MockACS) Checkout(ctx context.Context, req *sip2.CheckoutRequest) (*sip2.CheckoutResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewCheckoutResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	*resp.ItemID.StrValue = *req.ItemID.StrValue
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	item, itemOK := m.items[string(*req.ItemID.StrValue)]
+	noBlock := bool(*req.NoBlock.BoolValue)
+	switch {
+	case patron == nil:
+		*resp.ScreenMessage.StrValue = "unknown patron"
+		return resp, nil
+	case !validPassword:
+		*resp.ScreenMessage.StrValue = "invalid patron password"
+		return resp, nil
+	case !itemOK:
+		*resp.ScreenMessage.StrValue = "unknown item"
+		return resp, nil
+	}
+	*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+	*resp.MediaType.IntValue = sip2.IntValue(item.MediaType)
+	dueDate := m.dueDate()
+	if noBlock && !time.Time(*req.NBDueDate.TimeValue).IsZero() {
+		dueDate = time.Time(*req.NBDueDate.TimeValue)
+	}
+	if loan, onLoan := m.loans[item.ID]; onLoan {
+		if loan.PatronID != patron.ID {
+			*resp.ScreenMessage.StrValue = "item already charged"
+			return resp, nil
+		}
+		if !bool(*req.SCRenewalPolicy.BoolValue) && !noBlock {
+			*resp.ScreenMessage.StrValue = "item already charged to patron"
+			return resp, nil
+		}
+		loan.DueDate = formatDate(dueDate)
+		loan.Renewals++
+		*resp.OK.BoolValue = true
+		*resp.RenewalOK.BoolValue = true
+		*resp.Desensitize.BoolValue = true
+		*resp.DueDate.TimeValue = sip2.TimeValue(dueDate)
+		return resp, nil
+	}
+	if !noBlock {
+		switch {
+		case patron.Blocked:
+			*resp.ScreenMessage.StrValue = "patron blocked"
+			return resp, nil
+		case m.heldForOther(patron.ID, item.ID):
+			*resp.ScreenMessage.StrValue = "item on hold for another patron"
+			return resp, nil
+		case patron.ChargeLimit > 0 && len(m.patronLoans(patron.ID)) >= patron.ChargeLimit:
+			*resp.ScreenMessage.StrValue = "too many items charged"
+			return resp, nil
+		case patron.FeeLimit > 0 && m.patronFees(patron.ID) > patron.FeeLimit && !bool(*req.FeeAcknowledged.BoolValue):
+			*resp.ScreenMessage.StrValue = "excessive outstanding fines"
+			return resp, nil
+		}
+	}
+	m.loans[item.ID] = &Loan{PatronID: patron.ID, ItemID: item.ID, DueDate: formatDate(dueDate)}
+	m.removeHold(patron.ID, item.ID)
+	*resp.OK.BoolValue = true
+	*resp.Desensitize.BoolValue = true
+	*resp.DueDate.TimeValue = sip2.TimeValue(dueDate)
+	return resp, nil
+}
+
+func (m *MockACS) Checkin(ctx context.Context, req *sip2.CheckinRequest) (*sip2.CheckinResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewCheckinResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.ItemID.StrValue = *req.ItemID.StrValue
+	item, ok := m.items[string(*req.ItemID.StrValue)]
+	if !ok {
+		*resp.ScreenMessage.StrValue = "unknown item"
+		return resp, nil
+	}
+	if loan, onLoan := m.loans[item.ID]; onLoan {
+		*resp.PatronID.StrValue = sip2.StrValue(loan.PatronID)
+		delete(m.loans, item.ID)
+	}
+	if len(m.itemHolds(item.ID)) > 0 {
+		*resp.Alert.BoolValue = true
+		*resp.SortBin.StrValue = "HOLD"
+	}
+	*resp.OK.BoolValue = true
+	*resp.Resensitize.BoolValue = true
+	*resp.PermanentLocation.StrValue = sip2.StrValue(item.Location)
+	*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+	*resp.MediaType.IntValue = sip2.IntValue(item.MediaType)
+	return resp, nil
+}
+
+func (m *MockACS) BlockPatron(ctx context.Context, req *sip2.BlockPatronRequest) (*sip2.PatronStatusResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewPatronStatusResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	patron, ok := m.patrons[string(*req.PatronID.StrValue)]
+	if !ok {
+		*resp.PatronStatus.StrValue = "YYYY          "
+		*resp.ScreenMessage.StrValue = "unknown patron"
+		return resp, nil
+	}
+	patron.Blocked = true
+	*resp.PatronStatus.StrValue = sip2.StrValue(m.patronStatus(patron))
+	*resp.PersonalName.StrValue = sip2.StrValue(patron.Name)
+	*resp.ValidPatron.BoolValue = true
+	*resp.ScreenMessage.StrValue = *req.BlockedCardMsg.StrValue
+	return resp, nil
+}
+
+func (m *MockACS) EndPatronSession(ctx context.Context, req *sip2.EndPatronSessionRequest) (*sip2.EndSessionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewEndSessionResponse()
+	_, ok := m.patrons[string(*req.PatronID.StrValue)]
+	*resp.EndSession.BoolValue = sip2.BoolValue(ok)
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	return resp, nil
+}
+
+func (m *MockACS) FeePaid(ctx context.Context, req *sip2.FeePaidRequest) (*sip2.FeePaidResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewFeePaidResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	*resp.TransactionID.StrValue = *req.TransactionID.StrValue
+	patronID := string(*req.PatronID.StrValue)
+	amount := float64(*req.FeeAmount.FloatValue)
+	if _, ok := m.patrons[patronID]; !ok || amount <= 0 {
+		*resp.ScreenMessage.StrValue = "payment refused"
+		return resp, nil
+	}
+	feeID := string(*req.FeeID.StrValue)
+	for _, fine := range m.fines {
+		if amount <= 0 {
+			break
+		}
+		if fine.PatronID != patronID || (feeID != "" && fine.ID != feeID) {
+			continue
+		}
+		paid := fine.Amount
+		if amount < paid {
+			paid = amount
+		}
+		fine.Amount -= paid
+		amount -= paid
+	}
+	*resp.PaymentAccepted.BoolValue = true
+	return resp, nil
+}
+
+func (m *MockACS) ItemStatusUpdate(ctx context.Context, req *sip2.ItemStatusUpdateRequest) (*sip2.ItemStatusUpdateResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewItemStatusUpdateResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.ItemID.StrValue = *req.ItemID.StrValue
+	item, ok := m.items[string(*req.ItemID.StrValue)]
+	if !ok {
+		*resp.ScreenMessage.StrValue = "unknown item"
+		return resp, nil
+	}
+	item.Properties = *req.ItemProperties.StrSliceValue
+	*resp.ItemPropertiesOK.BoolValue = true
+	*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+	*resp.ItemProperties.StrSliceValue = item.Properties
+	return resp, nil
+}
+
+func (m *MockACS) PatronEnable(ctx context.Context, req *sip2.PatronEnableRequest) (*sip2.PatronEnableResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewPatronEnableResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	if patron == nil {
+		*resp.PatronStatus.StrValue = "YYYY          "
+		*resp.ScreenMessage.StrValue = "unknown patron"
+		return resp, nil
+	}
+	if validPassword {
+		patron.Blocked = false
+	}
+	*resp.PatronStatus.StrValue = sip2.StrValue(m.patronStatus(patron))
+	*resp.PersonalName.StrValue = sip2.StrValue(patron.Name)
+	*resp.ValidPatron.BoolValue = true
+	*resp.ValidPatronPassword.BoolValue = sip2.BoolValue(validPassword)
+	return resp, nil
+}
+
+func (m *MockACS) Hold(ctx context.Context, req *sip2.HoldRequest) (*sip2.HoldResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewHoldResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	*resp.ItemID.StrValue = *req.ItemID.StrValue
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	item, itemOK := m.items[string(*req.ItemID.StrValue)]
+	switch {
+	case patron == nil:
+		*resp.ScreenMessage.StrValue = "unknown patron"
+		return resp, nil
+	case !validPassword:
+		*resp.ScreenMessage.StrValue = "invalid patron password"
+		return resp, nil
+	case !itemOK:
+		*resp.ScreenMessage.StrValue = "unknown item"
+		return resp, nil
+	case patron.Blocked:
+		*resp.ScreenMessage.StrValue = "patron blocked"
+		return resp, nil
+	}
+	holds := m.itemHolds(item.ID)
+	position := len(holds) + 1
+	var existing *Hold
+	for i, hold := range holds {
+		if hold.PatronID == patron.ID {
+			position, existing = i+1, hold
+		}
+	}
+	switch string(*req.HoldMode.StrValue) {
+	case sip2.HoldModeDelete:
+		if existing == nil {
+			*resp.ScreenMessage.StrValue = "no such hold"
+			return resp, nil
+		}
+		for i, hold := range m.holds {
+			if hold == existing {
+				m.holds = append(m.holds[:i], m.holds[i+1:]...)
+				break
+			}
+		}
+		*resp.OK.BoolValue = true
+		*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+		return resp, nil
+	case sip2.HoldModeChange:
+		if existing == nil {
+			*resp.ScreenMessage.StrValue = "no such hold"
+			return resp, nil
+		}
+	default:
+		if existing == nil {
+			existing = &Hold{PatronID: patron.ID, ItemID: item.ID}
+			m.holds = append(m.holds, existing)
+		}
+	}
+	if pickup := string(*req.PickupLocation.StrValue); pickup != "" {
+		existing.PickupLocation = pickup
+	}
+	if expiration := time.Time(*req.ExpirationDate.TimeValue); !expiration.IsZero() {
+		existing.ExpirationDate = formatDate(expiration)
+	}
+	*resp.OK.BoolValue = true
+	*resp.QueuePosition.IntValue = sip2.IntValue(position)
+	*resp.ExpirationDate.TimeValue = *req.ExpirationDate.TimeValue
+	*resp.PickupLocation.StrValue = *req.PickupLocation.StrValue
+	*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+	return resp, nil
+}
+
+// renew extends a loan, returning a message explaining why when it is refused.
+func (m *MockACS) renew(patron *Patron, itemID string) (time.Time, string) {
+	loan, ok := m.loans[itemID]
+	switch {
+	case !ok || loan.PatronID != patron.ID:
+		return time.Time{}, "item not charged to patron"
+	case patron.Blocked:
+		return time.Time{}, "patron blocked"
+	case m.heldForOther(patron.ID, itemID):
+		return time.Time{}, "item on hold for another patron"
+	case m.fixtures.MaxRenewals > 0 && loan.Renewals >= m.fixtures.MaxRenewals:
+		return time.Time{}, "too many renewals"
+	}
+	dueDate := m.dueDate()
+	loan.DueDate = formatDate(dueDate)
+	loan.Renewals++
+	return dueDate, ""
+}
+
+func (m *MockACS) Renew(ctx context.Context, req *sip2.RenewRequest) (*sip2.RenewResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewRenewResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	*resp.PatronID.StrValue = *req.PatronID.StrValue
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	if patron == nil || !validPassword {
+		*resp.ScreenMessage.StrValue = "invalid patron"
+		return resp, nil
+	}
+	if item, ok := m.items[string(*req.ItemID.StrValue)]; ok {
+		*resp.TitleID.StrValue = sip2.StrValue(item.Title)
+		*resp.MediaType.IntValue = sip2.IntValue(item.MediaType)
+	}
+	dueDate, msg := m.renew(patron, string(*req.ItemID.StrValue))
+	if msg != "" {
+		*resp.ScreenMessage.StrValue = sip2.StrValue(msg)
+		return resp, nil
+	}
+	*resp.OK.BoolValue = true
+	*resp.RenewalOK.BoolValue = true
+	*resp.DueDate.TimeValue = sip2.TimeValue(dueDate)
+	return resp, nil
+}
+
+func (m *MockACS) RenewAll(ctx context.Context, req *sip2.RenewAllRequest) (*sip2.RenewAllResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := sip2.NewRenewAllResponse()
+	*resp.TransactionDate.TimeValue = sip2.TimeValue(m.Now())
+	*resp.InstitutionID.StrValue = sip2.StrValue(m.fixtures.InstitutionID)
+	patron, validPassword := m.checkPatron(string(*req.PatronID.StrValue), req.PatronPassword.StrValue)
+	if patron == nil || !validPassword {
+		*resp.ScreenMessage.StrValue = "invalid patron"
+		return resp, nil
+	}
+	renewed := make([]string, 0, 8)
+	unrenewed := make([]string, 0, 8)
+	for _, loan := range m.patronLoans(patron.ID) {
+		if _, msg := m.renew(patron, loan.ItemID); msg != "" {
+			unrenewed = append(unrenewed, loan.ItemID)
+		} else {
+			renewed = append(renewed, loan.ItemID)
+		}
+	}
+	*resp.OK.BoolValue = true
+	*resp.RenewedCount.IntValue = sip2.IntValue(len(renewed))
+	*resp.UnrenewedCount.IntValue = sip2.IntValue(len(unrenewed))
+	*resp.RenewedItems.StrSliceValue = renewed
+	*resp.UnrenewedItems.StrSliceValue = unrenewed
+	return resp, nil
+}
@@ -0,0 +1,90 @@
+package sip2test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+type Patron struct {
+	ID          string  `json:"id"`
+	Password    string  `json:"password"`
+	Name        string  `json:"name"`
+	Email       string  `json:"email"`
+	Address     string  `json:"address"`
+	Phone       string  `json:"phone"`
+	Blocked     bool    `json:"blocked"`
+	ChargeLimit int     `json:"charge_limit"`
+	FeeLimit    float64 `json:"fee_limit"`
+}
+
+type Item struct {
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	Author     string   `json:"author"`
+	ISBN       string   `json:"isbn"`
+	Owner      string   `json:"owner"`
+	Location   string   `json:"location"`
+	MediaType  int      `json:"media_type"`
+	Properties []string `json:"properties"`
+}
+
+type Loan struct {
+	PatronID string `json:"patron_id"`
+	ItemID   string `json:"item_id"`
+	DueDate  string `json:"due_date"`
+	Renewals int    `json:"renewals"`
+}
+
+type Hold struct {
+	PatronID       string `json:"patron_id"`
+	ItemID         string `json:"item_id"`
+	PickupLocation string `json:"pickup_location"`
+	ExpirationDate string `json:"expiration_date"`
+}
+
+type Fine struct {
+	ID       string  `json:"id"`
+	PatronID string  `json:"patron_id"`
+	ItemID   string  `json:"item_id"`
+	Amount   float64 `json:"amount"`
+}
+
+// Fixtures is the initial state of a MockACS, dates are formatted as 2006-01-02.
+type Fixtures struct {
+	InstitutionID string            `json:"institution_id"`
+	LibraryName   string            `json:"library_name"`
+	LoanDays      int               `json:"loan_days"`
+	MaxRenewals   int               `json:"max_renewals"`
+	Logins        map[string]string `json:"logins"`
+	Patrons       []Patron          `json:"patrons"`
+	Items         []Item            `json:"items"`
+	Loans         []Loan            `json:"loans"`
+	Holds         []Hold            `json:"holds"`
+	Fines         []Fine            `json:"fines"`
+}
+
+func LoadFixtures(path string) (*Fixtures, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixtures := &Fixtures{}
+	err = json.Unmarshal(b, fixtures)
+	if err != nil {
+		return nil, err
+	}
+	return fixtures, nil
+}
+
+func parseDate(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,213 @@
+package sip2test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type Fault int
+
+const (
+	// Pass forwards the message and its response untouched.
+	Pass Fault = iota
+	// Drop closes the SC connection without forwarding the message.
+	Drop
+	// HalfWrite forwards the message, then writes half of the response and closes the connection.
+	HalfWrite
+	// CorruptChecksum forwards the message and alters the checksum of the response.
+	CorruptChecksum
+	// CorruptRequest alters the checksum of the message before forwarding it.
+	CorruptRequest
+	// Duplicate forwards the message and writes its response twice.
+	Duplicate
+	// Stall swallows the message, the SC never gets a response.
+	Stall
+	// InvalidCommand answers the message as the 3M ACS does for a request it can't parse.
+	InvalidCommand
+)
+
+// FaultStep is applied to one SC message, Latency delays the message before the fault
+// whatever it is: the message is forwarded, dropped or answered Latency after it arrived.
+type FaultStep struct {
+	Fault   Fault
+	Latency time.Duration
+}
+
+// FaultProxy sits between a ClientPool and an ACS and applies the injected steps to
+// the SC messages in the order they arrive, across all connections. Messages arriving
+// once the script is exhausted are passed through.
+type FaultProxy struct {
+	target   string
+	listener net.Listener
+	addr     *net.TCPAddr
+	mu       sync.Mutex
+	script   []FaultStep
+	frames   []string
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func StartFaultProxy(host string, port int) (*FaultProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &FaultProxy{
+		target:   net.JoinHostPort(host, fmt.Sprint(port)),
+		listener: l,
+		addr:     l.Addr().(*net.TCPAddr),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go p.serve()
+	return p, nil
+}
+
+func (p *FaultProxy) Host() string {
+	return p.addr.IP.String()
+}
+
+func (p *FaultProxy) Port() int {
+	return p.addr.Port
+}
+
+func (p *FaultProxy) Inject(steps ...FaultStep) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.script = append(p.script, steps...)
+}
+
+// Frames returns the SC messages seen by the proxy so far.
+func (p *FaultProxy) Frames() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.frames...)
+}
+
+func (p *FaultProxy) Close() error {
+	err := p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func (p *FaultProxy) track(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range conns {
+		p.conns[conn] = struct{}{}
+	}
+}
+
+func (p *FaultProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+func (p *FaultProxy) next(frame []byte) FaultStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frames = append(p.frames, string(frame))
+	if len(p.script) == 0 {
+		return FaultStep{}
+	}
+	step := p.script[0]
+	p.script = p.script[1:]
+	return step
+}
+
+func (p *FaultProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.track(conn, upstream)
+		p.wg.Add(1)
+		go p.relay(conn, upstream)
+	}
+}
+
+func (p *FaultProxy) relay(conn, upstream net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(conn, upstream)
+	reader := bufio.NewReader(conn)
+	upstreamReader := bufio.NewReader(upstream)
+	for {
+		frame, err := reader.ReadBytes('\r')
+		if err != nil {
+			return
+		}
+		if frame[0] == '\n' {
+			frame = frame[1:]
+		}
+		step := p.next(frame)
+		time.Sleep(step.Latency)
+		switch step.Fault {
+		case Drop:
+			return
+		case Stall:
+			continue
+		case InvalidCommand:
+			_, err = conn.Write([]byte("无效指令\n"))
+			if err != nil {
+				return
+			}
+			continue
+		case CorruptRequest:
+			frame = corrupt(frame)
+		}
+		_, err = upstream.Write(frame)
+		if err != nil {
+			return
+		}
+		resp, err := upstreamReader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		switch step.Fault {
+		case HalfWrite:
+			conn.Write(resp[:len(resp)/2])
+			return
+		case CorruptChecksum:
+			resp = corrupt(resp)
+		case Duplicate:
+			resp = append(resp, resp...)
+		}
+		_, err = conn.Write(resp)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// corrupt changes the last checksum digit of a frame.
+func corrupt(frame []byte) []byte {
+	corrupted := append([]byte(nil), frame...)
+	for i := len(corrupted) - 1; i >= 0; i-- {
+		if corrupted[i] != '\r' && corrupted[i] != '\n' {
+			if corrupted[i] == '0' {
+				corrupted[i] = '1'
+			} else {
+				corrupted[i] = '0'
+			}
+			break
+		}
+	}
+	return corrupted
+}
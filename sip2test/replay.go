@@ -0,0 +1,156 @@
+package sip2test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sip2"
+	"sync"
+)
+
+type exchange struct {
+	commandID string
+	response  string
+	used      bool
+}
+
+// ReplayACS answers SC messages from a recorded transcript. Every message gets the response
+// of the first unused recorded exchange with the same command id, so a conversation replays
+// deterministically as long as the SC sends the messages in the recorded order. Responses are
+// reframed with the sequence number of the message they answer.
+type ReplayACS struct {
+	mu        sync.Mutex
+	exchanges []*exchange
+	listener  net.Listener
+	addr      *net.TCPAddr
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+func NewReplayACS(records []sip2.Record) (*ReplayACS, error) {
+	r := &ReplayACS{conns: make(map[net.Conn]struct{})}
+	pending := make(map[string]string)
+	for _, record := range records {
+		switch record.Direction {
+		case sip2.DirectionRequest:
+			if len(record.Frame) < 2 {
+				return nil, errors.New("NewReplayACS: request frame too short")
+			}
+			pending[record.ConnID] = record.Frame[:2]
+		case sip2.DirectionResponse:
+			commandID, ok := pending[record.ConnID]
+			if !ok {
+				continue
+			}
+			delete(pending, record.ConnID)
+			r.exchanges = append(r.exchanges, &exchange{commandID: commandID, response: record.Frame})
+		}
+	}
+	return r, nil
+}
+
+func StartReplayACS(records []sip2.Record) (*ReplayACS, error) {
+	r, err := NewReplayACS(records)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r.listener = l
+	r.addr = l.Addr().(*net.TCPAddr)
+	go r.serve()
+	return r, nil
+}
+
+func (r *ReplayACS) Host() string {
+	return r.addr.IP.String()
+}
+
+func (r *ReplayACS) Port() int {
+	return r.addr.Port
+}
+
+// Remaining returns the number of recorded exchanges not replayed yet.
+func (r *ReplayACS) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var remaining int
+	for _, ex := range r.exchanges {
+		if !ex.used {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+func (r *ReplayACS) Close() error {
+	err := r.listener.Close()
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+func (r *ReplayACS) next(commandID string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ex := range r.exchanges {
+		if !ex.used && ex.commandID == commandID {
+			ex.used = true
+			return ex.response, true
+		}
+	}
+	return "", false
+}
+
+func (r *ReplayACS) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns[conn] = struct{}{}
+		r.mu.Unlock()
+		r.wg.Add(1)
+		go r.serveConn(conn)
+	}
+}
+
+func (r *ReplayACS) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+		r.wg.Done()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := reader.ReadBytes('\r')
+		if err != nil {
+			return
+		}
+		body, seq, err := sip2.ParseFrame(frame, false)
+		if err != nil || len(body) < 2 {
+			return
+		}
+		response, ok := r.next(string(body[:2]))
+		if !ok {
+			return
+		}
+		body, _, err = sip2.ParseFrame([]byte(response), false)
+		if err != nil {
+			return
+		}
+		_, err = conn.Write(append(sip2.BuildFrame(body, seq), '\n'))
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package sip2
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Load builds the client side tls.Config of NewTLSClientPool.
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("*TLSConfig.Load: unknown min_version %q", c.MinVersion)
+	}
+	cfg := &tls.Config{ServerName: c.ServerName, MinVersion: version}
+	if c.CAFile != "" {
+		roots, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = roots
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Load builds the server side tls.Config of the gateway.
+func (c *ServerTLSConfig) Load() (*tls.Config, error) {
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("*ServerTLSConfig.Load: unknown min_version %q", c.MinVersion)
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: version}
+	switch c.ClientAuth {
+	case "", "none":
+		return cfg, nil
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("*ServerTLSConfig.Load: unknown client_auth %q", c.ClientAuth)
+	}
+	if c.ClientCAFile == "" {
+		return nil, errors.New("*ServerTLSConfig.Load: client_auth requires client_ca_file")
+	}
+	cfg.ClientCAs, err = loadCertPool(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("loadCertPool: no certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// ClientCertCN returns the common name of the verified client certificate of a request,
+// empty when the client sent none.
+func ClientCertCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,233 @@
+package sip2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C trace context header of the requests continuing a trace.
+const TraceParentHeader = "traceparent"
+
+// Span is a timed step of a trace, End is called once.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts the spans of the gateway and of its pool: a span is the child of the span in
+// ctx, or of the remote parent of TraceParentFromContext when there is none.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
+
+// WithTracer traces every request of the gateway and the exchanges of its pool with t, see
+// ClientPool.SetTracer. A traceparent header makes the request span continue its trace.
+func WithTracer(t Tracer) Option {
+	return func(ss *SIPServer) {
+		ss.tracer = t
+		ss.pool.SetTracer(t)
+	}
+}
+
+// SetTracer makes every exchange of the pool a span with children for the pool wait, each
+// attempt and in them the dial, the login, the write, the read and the decode. It should be
+// called before the pool is in use.
+func (p *ClientPool) SetTracer(t Tracer) {
+	p.tracer = t
+}
+
+type spanKey struct{}
+
+// startSpan starts a span with t and keeps it in the context for SpanFromContext.
+func startSpan(t Tracer, ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// endSpan records err, when not nil, and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// SpanFromContext returns the current span of ctx, a span doing nothing when there is none.
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// traced starts the span of every request, as a child of its traceparent header if valid.
+func (ss *SIPServer) traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if tp, err := ParseTraceParent(r.Header.Get(TraceParentHeader)); err == nil {
+			ctx = ContextWithTraceParent(ctx, tp)
+		}
+		ctx, span := startSpan(ss.tracer, ctx, "sip2.http")
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.path", r.URL.Path)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", sw.status)
+	})
+}
+
+// TraceParent is a W3C trace context parent, the IDs in lowercase hex.
+type TraceParent struct {
+	TraceID string
+	SpanID  string
+	Flags   byte
+}
+
+var errTraceParent = errors.New("ParseTraceParent: not a valid traceparent")
+
+// ParseTraceParent reads a traceparent header of version 00, or of a later version by its
+// first four fields.
+func ParseTraceParent(s string) (TraceParent, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return TraceParent{}, errTraceParent
+	}
+	tp := TraceParent{TraceID: parts[1], SpanID: parts[2]}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 || !isHexID(tp.TraceID, 32) || !isHexID(tp.SpanID, 16) {
+		return TraceParent{}, errTraceParent
+	}
+	if _, err = hex.DecodeString(parts[0]); err != nil {
+		return TraceParent{}, errTraceParent
+	}
+	tp.Flags = flags[0]
+	return tp, nil
+}
+
+// isHexID is true for lowercase hex of length n, not all zeros.
+func isHexID(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (tp TraceParent) Sampled() bool {
+	return tp.Flags&1 == 1
+}
+
+func (tp TraceParent) String() string {
+	return "00-" + tp.TraceID + "-" + tp.SpanID + "-" + hex.EncodeToString([]byte{tp.Flags})
+}
+
+type traceParentKey struct{}
+
+func ContextWithTraceParent(ctx context.Context, tp TraceParent) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, tp)
+}
+
+// TraceParentFromContext returns the remote parent of the traces started in ctx.
+func TraceParentFromContext(ctx context.Context) (TraceParent, bool) {
+	tp, ok := ctx.Value(traceParentKey{}).(TraceParent)
+	return tp, ok
+}
+
+// LogTracer is the Tracer logging every span as it ends, at info level. The traces continued
+// from an unsampled traceparent are not logged.
+type LogTracer struct {
+	logger Logger
+}
+
+func NewLogTracer(logger Logger) *LogTracer {
+	return &LogTracer{logger: logger}
+}
+
+type logSpan struct {
+	logger   Logger
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	sampled  bool
+	start    time.Time
+	mu       sync.Mutex
+	fields   []LogField
+	err      error
+}
+
+type logSpanKey struct{}
+
+func (lt *LogTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &logSpan{logger: lt.logger, name: name, spanID: randomHex(8), sampled: true, start: time.Now()}
+	if parent, ok := ctx.Value(logSpanKey{}).(*logSpan); ok {
+		span.traceID, span.parentID, span.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else if tp, ok := TraceParentFromContext(ctx); ok {
+		span.traceID, span.parentID, span.sampled = tp.TraceID, tp.SpanID, tp.Sampled()
+	} else {
+		span.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, logSpanKey{}, span), span
+}
+
+func (ls *logSpan) SetAttribute(key string, value interface{}) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.fields = append(ls.fields, F(key, value))
+}
+
+func (ls *logSpan) RecordError(err error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.err = err
+}
+
+func (ls *logSpan) End() {
+	if !ls.sampled {
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	fields := []LogField{
+		F("name", ls.name),
+		F("trace_id", ls.traceID),
+		F("span_id", ls.spanID),
+		F("parent_id", ls.parentID),
+		F("duration_ms", float64(time.Since(ls.start).Microseconds())/1000),
+	}
+	fields = append(fields, ls.fields...)
+	if ls.err != nil {
+		fields = append(fields, F("error", ls.err))
+	}
+	ls.logger.Log(LevelInfo, "span", fields...)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
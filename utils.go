@@ -11,6 +11,7 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,12 +22,113 @@ type SIPConfig struct {
 	Timeout        int    `json:"timeout"`
 	RetryTimes     int    `json:"retry_times"`
 	ErrorDetection bool   `json:"error_detection"`
+	// the pooled connections are logged in when LoginUserID is set
+	LoginUserID   string `json:"login_user_id"`
+	LoginPassword string `json:"login_password"`
+	LocationCode  string `json:"location_code"`
+	// an End Patron Session is sent on shutdown for the patrons whose session is still open
+	EndSessionsOnClose bool `json:"end_sessions_on_close"`
+	// the connections to the ACS are over TLS when set
+	TLS *TLSConfig `json:"tls"`
+}
+
+// TLSConfig is the TLS of the connections to the ACS: the CA bundle verifying the ACS
+// (the system roots when empty), the client certificate, the expected server name and the
+// minimum version ("1.2" by default).
+type TLSConfig struct {
+	CAFile     string `json:"ca_file"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	ServerName string `json:"server_name"`
+	MinVersion string `json:"min_version"`
+}
+
+// ServerTLSConfig is the TLS of the HTTP gateway. ClientAuth is "none", "optional" or
+// "require", the client certificates are verified with the CA bundle of ClientCAFile.
+type ServerTLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+	ClientAuth   string `json:"client_auth"`
+	MinVersion   string `json:"min_version"`
 }
 
 type ServerConfig struct {
 	Host      string    `json:"host"`
 	Port      int       `json:"port"`
 	SIPConfig SIPConfig `json:"sip_config"`
+	// the gateway serves HTTPS when set
+	TLS *ServerTLSConfig `json:"tls"`
+	// when set, every client is matched to a profile by API key or certificate
+	Profiles []Profile `json:"profiles"`
+	// when set, every request is authenticated by API key or HMAC signature
+	APIKeys []APIKey `json:"api_keys"`
+	// the requests over these limits are refused with a 429
+	RateLimits *RateLimitConfig `json:"rate_limits"`
+	// the responses of the requests with an Idempotency-Key are kept for the repeats
+	Idempotency *IdempotencyConfig `json:"idempotency"`
+	// checkouts and checkins are journaled when the ACS is unreachable
+	Offline *OfflineConfig `json:"offline"`
+	// every exchange with the ACS is appended to an audit log
+	Audit *AuditConfig `json:"audit"`
+	// the gateway logs to the standard error, at info level by default
+	Log *LogConfig `json:"log"`
+}
+
+// LogConfig is the lowest level logged (debug, info, warn or error) and the methods of the
+// JSON API whose frames are logged in full at debug level, the others are redacted. Trace logs
+// the spans of every request, see LogTracer.
+type LogConfig struct {
+	Level      string   `json:"level"`
+	FrameDebug []string `json:"frame_debug"`
+	// every request is traced, its spans logged at info level
+	Trace bool `json:"trace"`
+}
+
+// AuditConfig is the audit log, rotated once it reaches MaxBytes when set.
+type AuditConfig struct {
+	File     string `json:"file"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// OfflineConfig is the journal of the offline transactions, the report of the ones the ACS
+// refused on replay, the loan period of the provisional due dates (14 days by default) and
+// the seconds between replay attempts (30 by default). TerminalPassword is replayed with the
+// entries of the clients without a profile setting one, the passwords are not journaled.
+type OfflineConfig struct {
+	Journal          string `json:"journal"`
+	Report           string `json:"report"`
+	LoanDays         int    `json:"loan_days"`
+	ProbeInterval    int    `json:"probe_interval"`
+	TerminalPassword string `json:"terminal_password"`
+}
+
+// IdempotencyConfig keeps the responses for Window seconds (24 hours when 0), in File when
+// set or in memory.
+type IdempotencyConfig struct {
+	Window int    `json:"window"`
+	File   string `json:"file"`
+}
+
+// RateLimitConfig sets the token buckets of every authenticated API key (none without an
+// authenticator), terminal (client certificate or address) and patron id.
+type RateLimitConfig struct {
+	PerKey      RateBudget `json:"per_key"`
+	PerTerminal RateBudget `json:"per_terminal"`
+	PerPatron   RateBudget `json:"per_patron"`
+}
+
+// RateBudget has a limit for the read-only methods and one for the others.
+type RateBudget struct {
+	Read  RateLimit `json:"read"`
+	Write RateLimit `json:"write"`
+}
+
+// RateLimit is a token bucket: Rate requests per second, Burst requests at once. A zero
+// Rate does not limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
 }
 
 func loadConfig(configPath string) (*ServerConfig, error) {
@@ -48,11 +150,11 @@ func loadConfig(configPath string) (*ServerConfig, error) {
 }
 
 func genChecksum(bs []byte) string {
-	var total int
+	var total uint16
 	for _, b := range bs {
-		total += int(b)
+		total += uint16(b)
 	}
-	return fmt.Sprintf("%X\r", (total^0xffff)+1)
+	return fmt.Sprintf("%04X\r", -total)
 }
 
 func checkSum(bs []byte) error {
@@ -68,13 +170,86 @@ func checkSum(bs []byte) error {
 	if err != nil {
 		return errors.New("checkSum: sum value not valid")
 	}
-	fmt.Printf("%d:%d\n", -s, sum)
 	if uint16(sum) != -s {
 		return errors.New("checkSum: corrupted data")
 	}
 	return nil
 }
 
+// ParseFrame strips the line terminator and the AY/AZ trailer from a raw message.
+// The checksum is verified when errorDetection is set, seq is -1 when the message
+// carries no sequence number.
+func ParseFrame(b []byte, errorDetection bool) (body []byte, seq int, err error) {
+	b = bytes.TrimLeft(b, "\r\n")
+	b = bytes.TrimRight(b, "\r\n")
+	seq = -1
+	if l := len(b); l >= 6 && string(b[l-6:l-4]) == "AZ" {
+		if errorDetection {
+			err = checkSum(append(b[:l:l], '\r'))
+			if err != nil {
+				return nil, -1, err
+			}
+		}
+		b = b[:l-6]
+	}
+	if l := len(b); l >= 3 && string(b[l-3:l-1]) == "AY" && b[l-1] >= '0' && b[l-1] <= '9' {
+		seq = int(b[l-1] - '0')
+		b = b[:l-3]
+	}
+	return b, seq, nil
+}
+
+// BuildFrame appends the sequence number (when seq >= 0), the checksum and the
+// carriage return to a message body.
+func BuildFrame(body []byte, seq int) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(body)+16))
+	buffer.Write(body)
+	if seq >= 0 {
+		buffer.WriteString(fmt.Sprintf("AY%d", seq%10))
+	}
+	buffer.WriteString("AZ")
+	buffer.WriteString(genChecksum(buffer.Bytes()))
+	return buffer.Bytes()
+}
+
+// fixedLength returns the length of the fixed part of a message, command id included,
+// or -1 when the command id is unknown.
+func fixedLength(commandID string) int {
+	msgType, ok := RequestMap[commandID]
+	length := 0
+	if !ok {
+		msgType, ok = ResponseMap[commandID]
+		if !ok {
+			return -1
+		}
+		length = len(commandID)
+	}
+	for i := 0; i < msgType.NumField(); i++ {
+		field := reflect.New(msgType.Field(i).Type).Elem().Interface().(SipField)
+		id, _, l := field.Info()
+		if id != "" || l == -1 {
+			continue
+		}
+		length += l
+	}
+	return length
+}
+
+// joinErrors returns nil when errs is empty and the only error when there is one.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
 func formatDate() string {
 	return time.Now().Format("20060102    150405")
 }
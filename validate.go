@@ -0,0 +1,152 @@
+package sip2
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxVariableLength caps the variable length fields, SIP2 allows 255 characters.
+const maxVariableLength = 255
+
+// ValidationError lists every invalid field of a request, keyed by its JSON name.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	reasons := make([]string, len(names))
+	for i, name := range names {
+		reasons[i] = name + ": " + e.Fields[name]
+	}
+	return "invalid request: " + strings.Join(reasons, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// Validate checks a request against the validate tags of its fields (required,
+// oneof=a b c), the lengths of their Info and the range of their dates. The rules other
+// than required do not apply to an empty field. It returns a
+// *ValidationError listing every invalid field, nil when the request is valid.
+func Validate(req interface{}) error {
+	val := reflect.ValueOf(req).Elem()
+	invalid := make(map[string]string)
+	for i := 0; i < val.NumField(); i++ {
+		structField := val.Type().Field(i)
+		name := strings.Split(structField.Tag.Get("json"), ",")[0]
+		field, ok := val.Field(i).Interface().(SipField)
+		if !ok {
+			continue
+		}
+		if reason := validateField(field, val.Field(i).Field(0), structField.Tag.Get("validate")); reason != "" {
+			invalid[name] = reason
+		}
+	}
+	if len(invalid) > 0 {
+		return &ValidationError{Fields: invalid}
+	}
+	return nil
+}
+
+func validateField(field SipField, value reflect.Value, rules string) string {
+	if value.IsNil() {
+		if strings.Contains(rules, "required") {
+			return "required"
+		}
+		return ""
+	}
+	id, _, length := field.Info()
+	var text string
+	switch v := value.Interface().(type) {
+	case *StrValue:
+		text = string(*v)
+		if reason := checkLength(text, id, length); reason != "" {
+			return reason
+		}
+	case *StrSliceValue:
+		text = strings.Join(*v, "")
+		for _, s := range *v {
+			if reason := checkLength(s, id, -1); reason != "" {
+				return reason
+			}
+		}
+	case *IntValue:
+		text = strconv.Itoa(int(*v))
+		if *v < 0 {
+			return "must not be negative"
+		}
+		if length == 1 && *v > 9 {
+			return "at most 1 digit"
+		}
+		if length > 1 && float64(*v) >= math.Pow10(length) {
+			return fmt.Sprintf("at most %d digits", length)
+		}
+	case *FloatValue:
+		if *v != 0 {
+			text = strconv.FormatFloat(float64(*v), 'f', -1, 64)
+		}
+		if *v < 0 {
+			return "must not be negative"
+		}
+	case *BoolValue:
+		text = strconv.FormatBool(bool(*v))
+	case *TimeValue:
+		t := time.Time(*v)
+		if !t.IsZero() && (t.Year() < 1970 || t.Year() > 2099) {
+			return "date out of range"
+		}
+		if !t.IsZero() {
+			text = t.Format("2006-01-02 15:04:05")
+		}
+	}
+	empty := strings.TrimSpace(text) == "" || value.Elem().IsZero()
+	for _, rule := range strings.Split(rules, ",") {
+		switch {
+		case rule == "required":
+			if strings.TrimSpace(text) == "" {
+				return "required"
+			}
+		case empty:
+		case strings.HasPrefix(rule, "oneof="):
+			if !oneOf(text, strings.Fields(strings.TrimPrefix(rule, "oneof="))) {
+				return "must be one of " + strings.TrimPrefix(rule, "oneof=")
+			}
+		}
+	}
+	return ""
+}
+
+// checkLength rejects fixed fields longer than their length, variable fields longer than
+// 255 characters and the characters that would break the framing.
+func checkLength(s, id string, length int) string {
+	if strings.ContainsAny(s, "|\r\n") {
+		return "must not contain | or line breaks"
+	}
+	if length < 0 || id != "" && length == 0 {
+		length = maxVariableLength
+	}
+	if len(s) > length {
+		return fmt.Sprintf("longer than %d characters", length)
+	}
+	return ""
+}
+
+func oneOf(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}